@@ -0,0 +1,527 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"keycloakUpdater/v2/pkg/logger"
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+const dryRunUsage = "affiche les modifications sans les appliquer"
+const continueOnErrorUsage = "poursuit la mise à jour Keycloak après l'échec d'un utilisateur et liste les opérations en échec à la fin"
+
+// commandOptions holds the values of the flags of a command, each command only registers its own flags
+type commandOptions struct {
+	dryRun          bool
+	continueOnError bool
+	planOut         string
+	exportOut       string
+	driftJSON       string
+}
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	flags       func(flags *flag.FlagSet, options *commandOptions)
+	run         func(summary *runSummary, options commandOptions, args []string) error
+	// perTarget runs the command once per target of the [targets] section
+	perTarget bool
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{
+			name:        "sync",
+			usage:       "sync [--dry-run] [--continue-on-error] [keycloak|wekan]",
+			description: "synchronise Keycloak et/ou Wekan avec le fichier stock (commande par défaut)",
+			flags: func(flags *flag.FlagSet, options *commandOptions) {
+				flags.BoolVar(&options.dryRun, "dry-run", false, dryRunUsage)
+				flags.BoolVar(&options.continueOnError, "continue-on-error", false, continueOnErrorUsage)
+			},
+			run:       syncCommand,
+			perTarget: true,
+		},
+		{
+			name:        "validate",
+			usage:       "validate",
+			description: "vérifie chaque ligne du fichier stock sans se connecter à Keycloak ni à Wekan",
+			run:         validateCommand,
+			perTarget:   true,
+		},
+		{
+			name:        "diff",
+			usage:       "diff [--json drift.json] [keycloak|wekan]",
+			description: "affiche par utilisateur les écarts entre le fichier stock et Keycloak et/ou Wekan, sort avec le code 3 s'il y en a",
+			flags: func(flags *flag.FlagSet, options *commandOptions) {
+				flags.StringVar(&options.driftJSON, "json", "", "écrit aussi le rapport au format JSON dans ce fichier")
+			},
+			run:       diffCommand,
+			perTarget: true,
+		},
+		{
+			name:        "plan",
+			usage:       "plan [keycloak|wekan] [--out plan.json]",
+			description: "calcule les modifications et les enregistre dans un fichier de plan à faire valider",
+			flags: func(flags *flag.FlagSet, options *commandOptions) {
+				flags.StringVar(&options.planOut, "out", "plan.json", "chemin du fichier de plan à écrire")
+			},
+			run:       planCommand,
+			perTarget: true,
+		},
+		{
+			name:        "apply",
+			usage:       "apply [--continue-on-error] <fichier de plan>",
+			description: "applique un fichier de plan si le stock, Keycloak et Wekan n'ont pas changé depuis son calcul",
+			flags: func(flags *flag.FlagSet, options *commandOptions) {
+				flags.BoolVar(&options.continueOnError, "continue-on-error", false, continueOnErrorUsage)
+			},
+			run: applyCommand,
+		},
+		{
+			name:        "export",
+			usage:       "export [--out export.xlsx] [keycloak|wekan]",
+			description: "écrit l'état actuel de Keycloak et/ou Wekan dans un nouveau fichier stock",
+			flags: func(flags *flag.FlagSet, options *commandOptions) {
+				flags.StringVar(&options.exportOut, "out", "export.xlsx", "chemin du fichier stock à écrire, ne doit pas exister")
+			},
+			run:       exportCommand,
+			perTarget: true,
+		},
+		{
+			name:        "version",
+			usage:       "version",
+			description: "affiche la version de keycloakUpdater",
+			run:         versionCommand,
+		},
+		{
+			name:        "help",
+			usage:       "help [commande]",
+			description: "affiche l'aide générale ou celle d'une commande",
+			run:         helpCommand,
+		},
+	}
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage() {
+	output := flag.CommandLine.Output()
+	fmt.Fprintln(output, "usage : keycloakUpdater [--config fichier.toml] <commande> [options]")
+	fmt.Fprintln(output, "\ncommandes :")
+	for _, cmd := range commands {
+		fmt.Fprintf(output, "  %-45s %s\n", cmd.usage, cmd.description)
+	}
+	fmt.Fprintln(output, "\ncodes de sortie :")
+	fmt.Fprintf(output, "  %d  succès\n", exitOK)
+	fmt.Fprintf(output, "  %d  erreur pendant le traitement\n", exitError)
+	fmt.Fprintf(output, "  %d  erreur dans les arguments\n", exitUsage)
+	fmt.Fprintf(output, "  %d  des écarts ont été détectés (diff)\n", exitDiff)
+	fmt.Fprintf(output, "  %d  configuration invalide\n", exitConfig)
+	fmt.Fprintf(output, "  %d  fichier stock invalide\n", exitInvalidStock)
+	fmt.Fprintf(output, "  %d  trop de modifications utilisateurs (maxChangesToAccept)\n", exitTooManyChanges)
+	fmt.Fprintf(output, "  %d  échec de la mise à jour de Keycloak\n", exitKeycloak)
+	fmt.Fprintf(output, "  %d  échec de la mise à jour de Wekan\n", exitWekan)
+	fmt.Fprintf(output, "  %d  mise à jour partielle, une partie au moins a échoué\n", exitPartial)
+}
+
+func printCommandUsage(cmd command, flags *flag.FlagSet) {
+	output := flags.Output()
+	fmt.Fprintf(output, "usage : keycloakUpdater %s\n\n%s\n\noptions :\n", cmd.usage, cmd.description)
+	flags.PrintDefaults()
+}
+
+// syncScope selects the parts to process: Keycloak, Wekan or both
+type syncScope struct {
+	keycloak bool
+	wekan    bool
+}
+
+// scopeFromArgs reads the parts to process from args, every configured part by default
+func scopeFromArgs(conf structs.Config, args []string) (syncScope, error) {
+	keycloakConfigured := conf.Keycloak != nil
+	wekanConfigured := conf.Mongo != nil && conf.Wekan != nil
+	if len(args) == 0 {
+		return syncScope{keycloak: keycloakConfigured, wekan: wekanConfigured}, nil
+	}
+	var scope syncScope
+	for _, arg := range args {
+		switch arg {
+		case "keycloak":
+			if !keycloakConfigured {
+				return syncScope{}, errors.New("la section [keycloak] n'est pas configurée")
+			}
+			scope.keycloak = true
+		case "wekan":
+			if !wekanConfigured {
+				return syncScope{}, errors.New("les sections [mongo] et [wekan] ne sont pas configurées")
+			}
+			scope.wekan = true
+		default:
+			return syncScope{}, errors.Errorf("partie inconnue : %s (keycloak ou wekan)", arg)
+		}
+	}
+	return scope, nil
+}
+
+// prepare loads the configuration and the stock, then selects the parts to process
+func prepare(args []string) (structs.Config, syncScope, Users, CompositeRoles, error) {
+	conf, err := loadConfig()
+	if err != nil {
+		return structs.Config{}, syncScope{}, nil, nil, err
+	}
+	scope, err := scopeFromArgs(conf, args)
+	if err != nil {
+		return structs.Config{}, syncScope{}, nil, nil, UsageError{msg: err.Error()}
+	}
+	if err = validateStock(conf); err != nil {
+		return structs.Config{}, syncScope{}, nil, nil, err
+	}
+	users, compositeRoles, err := loadStock(conf)
+	if err != nil {
+		return structs.Config{}, syncScope{}, nil, nil, err
+	}
+	return conf, scope, users, compositeRoles, nil
+}
+
+func syncCommand(summary *runSummary, options commandOptions, args []string) error {
+	conf, scope, users, compositeRoles, err := prepare(args)
+	if err != nil {
+		return err
+	}
+	logContext := logger.ContextForMethod(syncCommand)
+	if options.dryRun {
+		changes := printPlans(summary, conf, scope, users, compositeRoles)
+		logger.Notice("dry-run : aucune modification appliquée", logContext.AddInt("changes", changes))
+		return nil
+	}
+	synchronize(summary, conf, scope, users, compositeRoles, options.continueOnError)
+	if summary.err() == nil {
+		logger.Notice("le traitement s'est terminé correctement ✌️", logContext)
+	}
+	return nil
+}
+
+func validateCommand(_ *runSummary, _ commandOptions, _ []string) error {
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if err = validateStock(conf); err != nil {
+		return err
+	}
+	users, _, err := loadStock(conf)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("le fichier %s est valide : %d utilisateur(s)\n", stockSource(*conf.Stock), len(users))
+	return nil
+}
+
+func diffCommand(summary *runSummary, options commandOptions, args []string) error {
+	conf, scope, users, compositeRoles, err := prepare(args)
+	if err != nil {
+		return err
+	}
+	report := newDriftReport(stockSource(*conf.Stock))
+	if scope.keycloak {
+		_ = summary.run("keycloak", func() error {
+			kc, err := NewKeycloakContext(conf.Keycloak)
+			if err != nil {
+				return err
+			}
+			if err = kc.configure(conf); err != nil {
+				return err
+			}
+			plan, err := PlanKeycloak(kc, conf.Stock.ClientForRoles, conf.Realm, conf.Clients, users, compositeRoles)
+			if err != nil {
+				return err
+			}
+			report.addKeycloakPlan(plan, keycloakAttributesDrifts(kc, users, plan))
+			return nil
+		})
+	}
+	if scope.wekan {
+		_ = summary.run("wekan", func() error {
+			plan, err := WekanPlanUpdate(
+				conf.Mongo.Url,
+				conf.Mongo.Database,
+				conf.Wekan.AdminUsername,
+				users,
+				conf.Wekan.SlugDomainRegexp,
+			)
+			if err != nil {
+				return err
+			}
+			report.addWekanPlan(plan)
+			return nil
+		})
+	}
+	report.Print(os.Stdout)
+	if options.driftJSON != "" {
+		if err = writeDriftReport(report, outputFilename(options.driftJSON)); err != nil {
+			return err
+		}
+	}
+	if err = summary.err(); err != nil {
+		return err
+	}
+	if changes := report.Changes(); changes > 0 {
+		return ChangesDetectedError{changes: changes}
+	}
+	return nil
+}
+
+// synchronize updates Keycloak then Wekan from the stock, a failing part doesn't prevent the other one
+func synchronize(summary *runSummary, conf structs.Config, scope syncScope, users Users, compositeRoles CompositeRoles, continueOnError bool) {
+	logContext := logger.ContextForMethod(synchronize)
+	if scope.keycloak {
+		keycloakLogContext := logContext.Clone()
+		logger.Notice("mise à jour des habilitations Keycloak", keycloakLogContext.AddString("status", "START"))
+		err := summary.run("keycloak", func() error {
+			kc, err := NewKeycloakContext(conf.Keycloak)
+			if err != nil {
+				return errors.Wrap(err, "erreur pendant l'initialisation du contexte Keycloak")
+			}
+			kc.ContinueOnError = continueOnError
+			if err = kc.configure(conf); err != nil {
+				return err
+			}
+			return UpdateKeycloak(
+				&kc,
+				conf.Stock.ClientForRoles,
+				conf.Realm,
+				conf.Clients,
+				users,
+				compositeRoles,
+				adminUsername(conf.Keycloak),
+				conf.Stock.MaxChangesToAccept,
+			)
+		})
+		if err != nil {
+			logger.Error("erreur pendant la mise à jour des habilitations Keycloak", logContext, err)
+		}
+		logger.Notice("mise à jour des habilitations Keycloak", keycloakLogContext.AddString("status", "END"))
+	}
+	if scope.wekan {
+		wekanLogContext := logContext.Clone()
+		logger.Notice("mise à jour des habilitations Wekan", wekanLogContext.AddString("status", "START"))
+		err := summary.run("wekan", func() error {
+			return WekanUpdate(
+				conf.Mongo.Url,
+				conf.Mongo.Database,
+				conf.Wekan.AdminUsername,
+				users,
+				conf.Wekan.SlugDomainRegexp,
+			)
+		})
+		if err != nil {
+			logger.Error("erreur pendant la mise à jour des habilitations Wekan", logContext, err)
+		}
+		logger.Notice("mise à jour des habilitations Wekan", wekanLogContext.AddString("status", "END"))
+	}
+}
+
+// planCommand computes the changes and writes them to a plan file
+func planCommand(summary *runSummary, options commandOptions, args []string) error {
+	conf, scope, users, compositeRoles, err := prepare(args)
+	if err != nil {
+		return err
+	}
+	logContext := logger.ContextForMethod(planCommand).AddString("out", outputFilename(options.planOut))
+
+	planFile, err := buildPlanFile(summary, conf, scope, users, compositeRoles)
+	if err != nil {
+		return err
+	}
+	planFile.Target = currentTarget
+	if planFile.Keycloak != nil {
+		planFile.Keycloak.Print(os.Stdout)
+	}
+	if planFile.Wekan != nil {
+		planFile.Wekan.Print(os.Stdout)
+	}
+	if err = writePlanFile(planFile, outputFilename(options.planOut)); err != nil {
+		return err
+	}
+	logger.Notice("plan enregistré", logContext)
+	return nil
+}
+
+// applyCommand applies a plan file if Keycloak and Wekan haven't changed since it was computed
+func applyCommand(summary *runSummary, options commandOptions, args []string) error {
+	if len(args) != 1 {
+		return UsageError{msg: "un fichier de plan est attendu"}
+	}
+	planFile, err := readPlanFile(args[0])
+	if err != nil {
+		return UsageError{msg: err.Error()}
+	}
+	// the plan is applied to the target it was computed for
+	if targetName != "" && targetName != planFile.Target {
+		return UsageError{msg: fmt.Sprintf("le plan a été calculé pour la cible %q", planFile.Target)}
+	}
+	currentTarget = planFile.Target
+	summary.target = planFile.Target
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if err = validateStock(conf); err != nil {
+		return err
+	}
+	users, compositeRoles, err := loadStock(conf)
+	if err != nil {
+		return err
+	}
+	if err = applyPlanFile(summary, conf, planFile, users, compositeRoles, options.continueOnError); err != nil {
+		return err
+	}
+	logger.Notice("le plan a été appliqué ✌️", logger.ContextForMethod(applyCommand))
+	return nil
+}
+
+// exportCommand writes the state of Keycloak and/or Wekan in the stock file format,
+// without Keycloak, users are taken from the current stock
+func exportCommand(summary *runSummary, options commandOptions, args []string) error {
+	out := outputFilename(options.exportOut)
+	if _, err := os.Stat(out); err == nil {
+		return UsageError{msg: fmt.Sprintf("le fichier %s existe déjà", out)}
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	scope, err := scopeFromArgs(conf, args)
+	if err != nil {
+		return UsageError{msg: err.Error()}
+	}
+	readOptions, err := stockOptionsFromConfig(*conf.Stock)
+	if err != nil {
+		return ConfigError{err: err}
+	}
+	var users Users
+	var compositeRoles CompositeRoles
+	if scope.keycloak {
+		err = summary.run("keycloak", func() error {
+			kc, err := NewKeycloakContext(conf.Keycloak)
+			if err != nil {
+				return errors.Wrap(err, "erreur pendant l'initialisation du contexte Keycloak")
+			}
+			if err = kc.configure(conf); err != nil {
+				return err
+			}
+			users, compositeRoles, err = exportKeycloak(kc, conf.Stock.ClientForRoles, readOptions.extraColumns)
+			return err
+		})
+	} else {
+		users, compositeRoles, err = loadStock(conf)
+	}
+	if err != nil {
+		return err
+	}
+	if scope.wekan {
+		err = summary.run("wekan", func() error {
+			wekan, err := initWekan(conf.Mongo.Url, conf.Mongo.Database, conf.Wekan.AdminUsername, conf.Wekan.SlugDomainRegexp)
+			if err != nil {
+				return err
+			}
+			users, err = exportWekan(wekan, users)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err = writeExcel(out, users, compositeRoles, readOptions); err != nil {
+		return err
+	}
+	logger.Notice("état exporté", logger.ContextForMethod(exportCommand).AddString("out", out))
+	return nil
+}
+
+func versionCommand(_ *runSummary, _ commandOptions, _ []string) error {
+	version, revision := "(devel)", "inconnue"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+	fmt.Printf("keycloakUpdater %s (révision %s)\n", version, revision)
+	return nil
+}
+
+func helpCommand(_ *runSummary, _ commandOptions, args []string) error {
+	if len(args) == 0 {
+		printUsage()
+		return nil
+	}
+	if _, found := findCommand(args[0]); !found {
+		return UsageError{msg: "commande inconnue : " + args[0]}
+	}
+	runCommand([]string{args[0], "-h"})
+	return nil
+}
+
+// printPlans computes and prints Keycloak and Wekan changes without applying them, and returns their count
+func printPlans(summary *runSummary, conf structs.Config, scope syncScope, users Users, compositeRoles CompositeRoles) int {
+	changes := 0
+	if scope.keycloak {
+		_ = summary.run("keycloak", func() error {
+			kc, err := NewKeycloakContext(conf.Keycloak)
+			if err != nil {
+				return err
+			}
+			if err = kc.configure(conf); err != nil {
+				return err
+			}
+			plan, err := PlanKeycloak(kc, conf.Stock.ClientForRoles, conf.Realm, conf.Clients, users, compositeRoles)
+			if err != nil {
+				return err
+			}
+			plan.Print(os.Stdout)
+			changes += plan.Changes()
+			if err = kc.checkChanges(users, conf.Stock.MaxChangesToAccept, time.Now()); err != nil {
+				fmt.Printf("la mise à jour de Keycloak serait refusée : %s\n", err)
+				return err
+			}
+			return nil
+		})
+	}
+	if scope.wekan {
+		_ = summary.run("wekan", func() error {
+			plan, err := WekanPlanUpdate(
+				conf.Mongo.Url,
+				conf.Mongo.Database,
+				conf.Wekan.AdminUsername,
+				users,
+				conf.Wekan.SlugDomainRegexp,
+			)
+			if err != nil {
+				return err
+			}
+			plan.Print(os.Stdout)
+			changes += plan.Changes()
+			return nil
+		})
+	}
+	return changes
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+func Test_scopeFromArgs_defaults_to_configured_parts(t *testing.T) {
+	ass := assert.New(t)
+	conf := structs.Config{Keycloak: &structs.Keycloak{}}
+
+	scope, err := scopeFromArgs(conf, nil)
+
+	ass.NoError(err)
+	ass.Equal(syncScope{keycloak: true, wekan: false}, scope)
+}
+
+func Test_scopeFromArgs_refuses_unconfigured_part(t *testing.T) {
+	ass := assert.New(t)
+	conf := structs.Config{Keycloak: &structs.Keycloak{}}
+
+	scope, err := scopeFromArgs(conf, []string{"keycloak"})
+	ass.NoError(err)
+	ass.Equal(syncScope{keycloak: true}, scope)
+
+	_, err = scopeFromArgs(conf, []string{"wekan"})
+	ass.Error(err)
+
+	_, err = scopeFromArgs(conf, []string{"inconnu"})
+	ass.Error(err)
+}
+
+func Test_runCommand_exit_codes(t *testing.T) {
+	ass := assert.New(t)
+	ass.Equal(exitUsage, runCommand([]string{"inconnue"}))
+	ass.Equal(exitOK, runCommand([]string{"version"}))
+	ass.Equal(exitOK, runCommand([]string{"plan", "-h"}))
+	ass.Equal(exitUsage, runCommand([]string{"apply"}))
+}
+
+func Test_runCommand_refuses_flags_of_other_commands(t *testing.T) {
+	ass := assert.New(t)
+	ass.Equal(exitUsage, runCommand([]string{"apply", "--dry-run", "plan.json"}))
+	ass.Equal(exitUsage, runCommand([]string{"export", "--dry-run"}))
+	ass.Equal(exitUsage, runCommand([]string{"validate", "--dry-run"}))
+	ass.Equal(exitUsage, runCommand([]string{"diff", "--continue-on-error"}))
+	ass.Equal(exitUsage, runCommand([]string{"plan", "--dry-run"}))
+}
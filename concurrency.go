@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Nerzal/gocloak/v13"
+
+	"keycloakUpdater/v2/pkg/logger"
+)
+
+// userProcess processes a user, records its failures in failures and returns false to stop processing.
+// Keycloak calls made with ctx log their retries in the user's block
+type userProcess func(ctx context.Context, i int, user gocloak.User, logContext *logger.LogContext, failures *failures) bool
+
+// forEachUser processes users with at most kc.Concurrency concurrent workers.
+// Logs of each user are written as one block and failures are collected, in the order of users.
+// After a stop, following users aren't processed and only the first failure is kept.
+func (kc KeycloakContext) forEachUser(users []gocloak.User, logContext *logger.LogContext, process userProcess) *failures {
+	type result struct {
+		buffer   *logger.Buffer
+		failures *failures
+	}
+	results := make([]result, len(users))
+	done := make([]chan struct{}, len(users))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	var stopped atomic.Bool
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range users {
+			if stopped.Load() {
+				close(done[i])
+				continue
+			}
+			jobs <- i
+		}
+	}()
+	var workers sync.WaitGroup
+	for w := 0; w < min(kc.concurrency(), len(users)); w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range jobs {
+				if !stopped.Load() {
+					buffer := &logger.Buffer{}
+					userFailures := kc.newFailures()
+					ctx := logger.ContextWithBuffer(context.Background(), buffer)
+					if !process(ctx, i, users[i], logContext.Clone().WithBuffer(buffer), userFailures) {
+						stopped.Store(true)
+					}
+					results[i] = result{buffer: buffer, failures: userFailures}
+				}
+				close(done[i])
+			}
+		}()
+	}
+
+	all := kc.newFailures()
+	for i := range users {
+		<-done[i]
+		if results[i].buffer == nil {
+			continue
+		}
+		results[i].buffer.Flush()
+		for _, err := range results[i].failures.errs {
+			if len(all.errs) > 0 && !kc.ContinueOnError {
+				break
+			}
+			all.add(err)
+		}
+	}
+	workers.Wait()
+	return all
+}
+
+// concurrency is the number of users processed concurrently, at least 1
+func (kc KeycloakContext) concurrency() int {
+	return max(kc.Concurrency, 1)
+}
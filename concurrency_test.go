@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"keycloakUpdater/v2/pkg/logger"
+)
+
+func usersNamed(count int) []gocloak.User {
+	users := make([]gocloak.User, count)
+	for i := range users {
+		username := fmt.Sprintf("user%d@example.com", i)
+		users[i] = gocloak.User{Username: &username}
+	}
+	return users
+}
+
+func Test_forEachUser_collects_failures_in_user_order(t *testing.T) {
+	ass := assert.New(t)
+	kc := KeycloakContext{Concurrency: 3, ContinueOnError: true}
+	var running, maxRunning atomic.Int32
+
+	failures := kc.forEachUser(usersNamed(8), logger.ContextForMethod(t.Name), func(_ context.Context, i int, user gocloak.User, _ *logger.LogContext, failures *failures) bool {
+		current := running.Add(1)
+		defer running.Add(-1)
+		for previous := maxRunning.Load(); current > previous && !maxRunning.CompareAndSwap(previous, current); previous = maxRunning.Load() {
+		}
+		// last users finish first
+		time.Sleep(time.Duration(8-i) * time.Millisecond)
+		if i%3 == 0 {
+			return !failures.add(errors.New(*user.Username))
+		}
+		return true
+	})
+
+	ass.LessOrEqual(maxRunning.Load(), int32(3))
+	ass.EqualError(failures.err(), "3 erreurs : user0@example.com ; user3@example.com ; user6@example.com")
+}
+
+func Test_forEachUser_stops_after_first_failure(t *testing.T) {
+	ass := assert.New(t)
+	kc := KeycloakContext{Concurrency: 1}
+	var processed []int
+
+	failures := kc.forEachUser(usersNamed(5), logger.ContextForMethod(t.Name), func(_ context.Context, i int, user gocloak.User, _ *logger.LogContext, failures *failures) bool {
+		processed = append(processed, i)
+		if i >= 1 {
+			return !failures.add(errors.New(*user.Username))
+		}
+		return true
+	})
+
+	ass.Equal([]int{0, 1}, processed)
+	ass.EqualError(failures.err(), "user1@example.com")
+}
+
+func Test_forEachUser_keeps_retry_logs_in_the_user_block(t *testing.T) {
+	ass := assert.New(t)
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+	var output bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&output, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	// each user first gets a transient error
+	var calls sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, seen := calls.LoadOrStore(r.URL.Path, true); !seen {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	transport := newRetryTransport(http.DefaultTransport, RetryPolicy{MaxAttempts: 2, StatusCodes: []int{http.StatusServiceUnavailable}}, nil)
+	transport.sleep = func(context.Context, time.Duration) error { return nil }
+	client := &http.Client{Transport: transport}
+	kc := KeycloakContext{Concurrency: 4}
+	users := usersNamed(8)
+
+	kc.forEachUser(users, logger.ContextForMethod(t.Name), func(ctx context.Context, i int, user gocloak.User, logContext *logger.LogContext, failures *failures) bool {
+		logContext.AddString("user", *user.Username)
+		logger.Info("début", logContext)
+		time.Sleep(time.Duration(8-i) * time.Millisecond)
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/"+*user.Username, nil)
+		ass.NoError(err)
+		response, err := client.Do(request)
+		ass.NoError(err)
+		discard(response)
+		logger.Info("fin", logContext)
+		return true
+	})
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	ass.Len(lines, 3*len(users))
+	for i, user := range users {
+		block := lines[3*i : 3*i+3]
+		ass.Contains(block[0], "msg=début")
+		ass.Contains(block[1], "nouvel essai")
+		ass.Contains(block[1], *user.Username)
+		ass.Contains(block[2], "msg=fin")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DriftReport groups by user the drifts between the stock and the state of Keycloak and Wekan
+type DriftReport struct {
+	CreatedAt     time.Time            `json:"createdAt"`
+	StockFilename string               `json:"stockFilename"`
+	Users         map[Username][]Drift `json:"users"`
+	Others        []Drift              `json:"others"`
+}
+
+// Drift describes a drift found on Keycloak or Wekan
+type Drift struct {
+	Target string `json:"target"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+func newDriftReport(stockFilename string) DriftReport {
+	return DriftReport{
+		CreatedAt:     time.Now(),
+		StockFilename: stockFilename,
+		Users:         make(map[Username][]Drift),
+	}
+}
+
+func (report DriftReport) addUserDrift(username Username, drift Drift) {
+	username = Username(strings.ToLower(string(username)))
+	report.Users[username] = append(report.Users[username], drift)
+}
+
+// addKeycloakPlan adds the drifts of the Keycloak plan, attributes details differing attributes by user
+func (report *DriftReport) addKeycloakPlan(plan KeycloakPlan, attributes map[Username][]string) {
+	for _, username := range plan.UsersToCreate {
+		report.addUserDrift(username, Drift{"keycloak", "missing", "absent de Keycloak"})
+	}
+	for _, username := range plan.UsersToDisable {
+		report.addUserDrift(username, Drift{"keycloak", "obsolete", "actif dans Keycloak mais absent du stock"})
+	}
+	for _, username := range plan.UsersToEnable {
+		report.addUserDrift(username, Drift{"keycloak", "disabled", "désactivé dans Keycloak"})
+	}
+	for _, username := range plan.UsersToUpdate {
+		report.addUserDrift(username, Drift{"keycloak", "attributes", strings.Join(attributes[username], ", ")})
+	}
+	for _, username := range plan.UsersToDelete {
+		report.addUserDrift(username, Drift{"keycloak", "expired", "désactivé depuis plus longtemps que la durée de rétention"})
+	}
+	for _, change := range plan.UsersRoles {
+		report.addUserDrift(change.Username, Drift{"keycloak", "roles", change.Client + formatAddRemove(change.Add, change.Remove)})
+	}
+	for _, change := range plan.UsersGroups {
+		report.addUserDrift(change.Username, Drift{"keycloak", "groups", strings.TrimSpace(formatAddRemove(change.Add, change.Remove))})
+	}
+	for _, client := range plan.ClientsToCreate {
+		report.Others = append(report.Others, Drift{"keycloak", "client", "client absent : " + client})
+	}
+	for _, role := range plan.RolesToCreate {
+		report.Others = append(report.Others, Drift{"keycloak", "role", "rôle absent : " + role})
+	}
+	for _, role := range plan.RolesToDelete {
+		report.Others = append(report.Others, Drift{"keycloak", "role", "rôle inutilisé : " + role})
+	}
+	for _, role := range plan.RealmRolesToCreate {
+		report.Others = append(report.Others, Drift{"keycloak", "realmRole", "rôle du realm absent : " + role})
+	}
+	for _, group := range plan.GroupsToCreate {
+		report.Others = append(report.Others, Drift{"keycloak", "group", "groupe absent : " + group})
+	}
+	for _, change := range plan.CompositeRoles {
+		report.Others = append(report.Others, Drift{"keycloak", "composite", change.Role + formatAddRemove(change.Add, change.Remove)})
+	}
+}
+
+// addWekanPlan adds the drifts of the Wekan plan
+func (report *DriftReport) addWekanPlan(plan WekanPlan) {
+	for _, username := range plan.UsersToCreate {
+		report.addUserDrift(Username(username), Drift{"wekan", "missing", "absent de Wekan"})
+	}
+	for _, username := range plan.UsersToEnable {
+		report.addUserDrift(Username(username), Drift{"wekan", "disabled", "désactivé dans Wekan"})
+	}
+	for _, username := range plan.UsersToDisable {
+		report.addUserDrift(Username(username), Drift{"wekan", "obsolete", "actif dans Wekan mais absent du stock"})
+	}
+	for _, change := range plan.BoardsMembers {
+		for _, username := range change.Add {
+			report.addUserDrift(Username(username), Drift{"wekan", "board", "n'est pas membre du tableau " + string(change.Board)})
+		}
+		for _, username := range change.Remove {
+			report.addUserDrift(Username(username), Drift{"wekan", "board", "membre du tableau " + string(change.Board) + " hors stock"})
+		}
+	}
+	addRules := func(rules []TaskforceRule, detail string) {
+		for _, rule := range rules {
+			report.addUserDrift(Username(rule.Username), Drift{"wekan", "rule", fmt.Sprintf("%s : %s/%s %s", detail, rule.Board, rule.Label, rule.Action)})
+		}
+	}
+	addRules(plan.RulesToAdd, "règle de taskforce manquante")
+	addRules(plan.RulesToRemove, "règle de taskforce hors stock")
+}
+
+// Changes counts the drifts
+func (report DriftReport) Changes() int {
+	count := len(report.Others)
+	for _, drifts := range report.Users {
+		count += len(drifts)
+	}
+	return count
+}
+
+// Print writes the report in a readable format, user by user
+func (report DriftReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "======= Écarts avec %s : %d écart(s), %d utilisateur(s)\n", report.StockFilename, report.Changes(), len(report.Users))
+	for _, username := range sortedKeys(report.Users) {
+		fmt.Fprintf(w, "%s\n", username)
+		for _, drift := range report.Users[username] {
+			fmt.Fprintf(w, "  [%s] %-10s %s\n", drift.Target, drift.Kind, drift.Detail)
+		}
+	}
+	if len(report.Others) > 0 {
+		fmt.Fprintln(w, "autres écarts :")
+		for _, drift := range report.Others {
+			fmt.Fprintf(w, "  [%s] %-10s %s\n", drift.Target, drift.Kind, drift.Detail)
+		}
+	}
+}
+
+func writeDriftReport(report DriftReport, filename string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(filename, data, 0644))
+}
+
+// keycloakAttributesDrifts details the attributes to update for each user of the plan
+func keycloakAttributesDrifts(kc KeycloakContext, users Users, plan KeycloakPlan) map[Username][]string {
+	attributes := make(map[Username][]string)
+	for _, username := range plan.UsersToUpdate {
+		kcUser, err := kc.GetUser(username)
+		if err != nil {
+			continue
+		}
+		attributes[username] = users[Username(strings.ToLower(string(username)))].attributesDrift(kcUser)
+	}
+	return attributes
+}
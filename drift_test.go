@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/signaux-faibles/libwekan"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DriftReport_groups_drifts_by_user(t *testing.T) {
+	ass := assert.New(t)
+	report := newDriftReport("userBase.xlsx")
+
+	report.addKeycloakPlan(KeycloakPlan{
+		ClientID:       "signauxfaibles",
+		UsersToDisable: []Username{"Raymond@example.com"},
+		UsersToUpdate:  []Username{"josette@example.com"},
+		UsersRoles:     []UserRolesChange{{Username: "josette@example.com", Client: "signauxfaibles", Add: Roles{"urssaf"}}},
+		RolesToDelete:  Roles{"obsolete"},
+	}, map[Username][]string{"josette@example.com": {`fonction : "" → "inspectrice"`}})
+	report.addWekanPlan(WekanPlan{
+		BoardsMembers: []BoardMembersChange{{Board: "tableau-crp-bfc", Remove: []libwekan.Username{"raymond@example.com"}}},
+	})
+
+	ass.Equal(5, report.Changes())
+	ass.Len(report.Users, 2)
+	ass.Equal([]Drift{
+		{"keycloak", "obsolete", "actif dans Keycloak mais absent du stock"},
+		{"wekan", "board", "membre du tableau tableau-crp-bfc hors stock"},
+	}, report.Users["raymond@example.com"])
+	ass.Equal(Drift{"keycloak", "roles", "signauxfaibles +urssaf"}, report.Users["josette@example.com"][1])
+
+	output := bytes.Buffer{}
+	report.Print(&output)
+	ass.Contains(output.String(), `[keycloak] attributes fonction : "" → "inspectrice"`)
+}
+
+func Test_DriftReport_without_drift(t *testing.T) {
+	ass := assert.New(t)
+	report := newDriftReport("userBase.xlsx")
+	report.addKeycloakPlan(KeycloakPlan{}, nil)
+	report.addWekanPlan(WekanPlan{})
+	ass.Equal(0, report.Changes())
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 //type MisconfiguredUserError struct {
@@ -38,3 +40,203 @@ func (e InvalidExcelFileError) Error() string {
 func (e InvalidExcelFileError) Unwrap() error {
 	return e.err
 }
+
+// UnknownBoardsError reports stock boards missing from Wekan, it is a failure of the Wekan part
+// and not a stock validation error
+type UnknownBoardsError struct {
+	slugs []string
+}
+
+func (e UnknownBoardsError) Error() string {
+	return fmt.Sprintf("le fichier contient des références de boards inexistantes : %s", strings.Join(e.slugs, ", "))
+}
+
+type PlanDriftError struct {
+	target string
+	msg    string
+}
+
+func (e PlanDriftError) Error() string {
+	return fmt.Sprintf("le plan n'est plus applicable (%s) : %s", e.target, e.msg)
+}
+
+type ConfigError struct {
+	err error
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("erreur de configuration : %s", e.err)
+}
+
+func (e ConfigError) Unwrap() error {
+	return e.err
+}
+
+type UsageError struct {
+	msg string
+}
+
+func (e UsageError) Error() string {
+	return e.msg
+}
+
+type TooManyChangesError struct {
+	changes int
+	keeps   int
+	max     int
+}
+
+func (e TooManyChangesError) Error() string {
+	if e.keeps < 1 {
+		return fmt.Sprintf("trop de modifications utilisateurs : %d modification(s) et aucun utilisateur conservé", e.changes)
+	}
+	return fmt.Sprintf("trop de modifications utilisateurs : %d modification(s) pour un maximum de %d", e.changes, e.max)
+}
+
+// TooManyDeletionsError reports more user deletions than the configured maximum
+type TooManyDeletionsError struct {
+	deletions int
+	max       int
+}
+
+func (e TooManyDeletionsError) Error() string {
+	return fmt.Sprintf("trop d'utilisateurs à supprimer : %d pour un maximum de %d", e.deletions, e.max)
+}
+
+type ChangesDetectedError struct {
+	changes int
+}
+
+func (e ChangesDetectedError) Error() string {
+	return fmt.Sprintf("%d écart(s) détecté(s)", e.changes)
+}
+
+type SyncError struct {
+	part string
+	err  error
+}
+
+func (e SyncError) Error() string {
+	return fmt.Sprintf("la partie %s a échoué : %s", e.part, e.err)
+}
+
+func (e SyncError) Unwrap() error {
+	return e.err
+}
+
+type PartialSyncError struct {
+	succeeded []string
+	err       error
+}
+
+func (e PartialSyncError) Error() string {
+	return fmt.Sprintf("traitement partiel, seules ces parties ont réussi : %s", strings.Join(e.succeeded, ", "))
+}
+
+func (e PartialSyncError) Unwrap() error {
+	return e.err
+}
+
+type MultiError []error
+
+func (e MultiError) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d erreurs : %s", len(e), strings.Join(messages, " ; "))
+}
+
+func (e MultiError) Unwrap() []error {
+	return e
+}
+
+// label describes the grouped errors according to their type, for the error detail output
+func (e MultiError) label() string {
+	var stockErrors, syncErrors, operationErrors int
+	for _, err := range e {
+		switch err.(type) {
+		case StockError:
+			stockErrors++
+		case SyncError:
+			syncErrors++
+		case OperationError:
+			operationErrors++
+		}
+	}
+	switch {
+	case stockErrors == len(e):
+		return fmt.Sprintf("%d erreur(s) dans le fichier stock", len(e))
+	case syncErrors == len(e):
+		return fmt.Sprintf("%d partie(s) en échec", len(e))
+	case operationErrors > 0:
+		return fmt.Sprintf("%d opération(s) en échec", len(e))
+	default:
+		return fmt.Sprintf("%d erreur(s)", len(e))
+	}
+}
+
+// OperationError describes a failed Keycloak operation on a user or a role
+type OperationError struct {
+	operation string
+	target    string
+	err       error
+}
+
+func (e OperationError) Error() string {
+	return fmt.Sprintf("%s %s : %s", e.operation, e.target, e.err)
+}
+
+func (e OperationError) Unwrap() error {
+	return e.err
+}
+
+// failures collects failed operations, only the first one is kept if continueOnError is false
+type failures struct {
+	continueOnError bool
+	errs            MultiError
+}
+
+// add records the error and tells whether processing must stop
+func (f *failures) add(err error) bool {
+	if err == nil {
+		return false
+	}
+	if multi, ok := err.(MultiError); ok {
+		f.errs = append(f.errs, multi...)
+	} else {
+		f.errs = append(f.errs, err)
+	}
+	return !f.continueOnError
+}
+
+func (f *failures) err() error {
+	return joinErrors(f.errs)
+}
+
+// StockError locates an error in the stock file
+type StockError struct {
+	sheet  string
+	row    int
+	column string
+	msg    string
+}
+
+func (e StockError) Error() string {
+	return fmt.Sprintf("%s, ligne %d, %s : %s", e.sheet, e.row, e.column, e.msg)
+}
+
+// DuplicateUserError reports an email address found on several rows of the stock
+type DuplicateUserError struct {
+	email Username
+	rows  []int
+	msg   string
+}
+
+func (e DuplicateUserError) Error() string {
+	rows := strings.Join(mapSlice(e.rows, strconv.Itoa), ", ")
+	if e.msg == "" {
+		return fmt.Sprintf("l'adresse %s est présente lignes %s", e.email, rows)
+	}
+	return fmt.Sprintf("l'adresse %s est présente lignes %s : %s", e.email, rows, e.msg)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_failures_stops_at_first_error_by_default(t *testing.T) {
+	ass := assert.New(t)
+	f := failures{}
+
+	ass.False(f.add(nil))
+	ass.NoError(f.err())
+	ass.True(f.add(OperationError{"création de l'utilisateur", "raymond", errors.New("409")}))
+	ass.EqualError(f.err(), "création de l'utilisateur raymond : 409")
+}
+
+func Test_failures_collects_errors_when_continueOnError(t *testing.T) {
+	ass := assert.New(t)
+	f := failures{continueOnError: true}
+
+	ass.False(f.add(OperationError{"création de l'utilisateur", "raymond", errors.New("409")}))
+	ass.False(f.add(MultiError{errors.New("a"), errors.New("b")}))
+
+	var multi MultiError
+	ass.ErrorAs(f.err(), &multi)
+	ass.Len(multi, 3)
+}
+
+func Test_TooManyChangesError_reports_counts_and_limit(t *testing.T) {
+	ass := assert.New(t)
+	ass.EqualError(
+		TooManyChangesError{changes: 12, keeps: 40, max: 10},
+		"trop de modifications utilisateurs : 12 modification(s) pour un maximum de 10",
+	)
+	ass.EqualError(
+		TooManyChangesError{changes: 3, keeps: 0, max: 10},
+		"trop de modifications utilisateurs : 3 modification(s) et aucun utilisateur conservé",
+	)
+}
+
+func Test_MultiError_label_depends_on_the_errors(t *testing.T) {
+	ass := assert.New(t)
+	stockErrors := MultiError{
+		StockError{NOM_PREMIERE_PAGE, 2, "PRENOM", "prénom absent"},
+		StockError{NOM_PREMIERE_PAGE, 3, "PRENOM", "prénom absent"},
+	}
+	ass.Equal("2 erreur(s) dans le fichier stock", stockErrors.label())
+
+	syncErrors := MultiError{SyncError{"keycloak", errors.New("401")}, SyncError{"wekan", errors.New("timeout")}}
+	ass.Equal("2 partie(s) en échec", syncErrors.label())
+
+	operationErrors := MultiError{OperationError{"création de l'utilisateur", "raymond", errors.New("409")}, errors.New("500")}
+	ass.Equal("2 opération(s) en échec", operationErrors.label())
+
+	ass.Equal("2 erreur(s)", MultiError{errors.New("a"), errors.New("b")}.label())
+}
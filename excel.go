@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/tealeg/xlsx/v3"
+	"keycloakUpdater/v2/pkg/logger"
 )
 
 var HEADERS = []string{
@@ -22,125 +25,255 @@ var HEADERS = []string{
 	"TASKFORCE",
 }
 
+// OPTIONAL_HEADERS are the optional columns of the first sheet
+var OPTIONAL_HEADERS = []string{"DEBUT", "FIN", "ROLES REALM", "GROUPES"}
+
 var NOM_PREMIERE_PAGE = "utilisateurs"
 
+// stockHeaders returns the required headers followed by the optional headers
+func stockHeaders() []string {
+	return append(slices.Clone(HEADERS), OPTIONAL_HEADERS...)
+}
+
+// DuplicatesStrategy tells how to handle several rows with the same email address
+type DuplicatesStrategy string
+
+const (
+	// duplicatesError rejects the file
+	duplicatesError DuplicatesStrategy = "error"
+	// duplicatesFirst keeps the first row
+	duplicatesFirst DuplicatesStrategy = "first"
+	// duplicatesLast keeps the last row
+	duplicatesLast DuplicatesStrategy = "last"
+	// duplicatesMerge merges scopes, boards and taskforces, other columns must be identical
+	duplicatesMerge DuplicatesStrategy = "merge"
+)
+
+func parseDuplicatesStrategy(value string) (DuplicatesStrategy, error) {
+	if value == "" {
+		return duplicatesError, nil
+	}
+	strategy := DuplicatesStrategy(strings.ToLower(value))
+	if !contains([]DuplicatesStrategy{duplicatesError, duplicatesFirst, duplicatesLast, duplicatesMerge}, strategy) {
+		return "", fmt.Errorf("stratégie de doublons inconnue : %s (error, first, last ou merge)", value)
+	}
+	return strategy, nil
+}
+
+// parseStockDate reads a date formatted as 2006-01-02, 02/01/2006 or an Excel serial number, an empty cell gives a zero date
+func parseStockDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{"2006-01-02", "02/01/2006", "2/1/2006"} {
+		if date, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return date, nil
+		}
+	}
+	// Excel counts days since December 30, 1899
+	if serial, err := strconv.ParseFloat(value, 64); err == nil && serial > 0 {
+		return time.Date(1899, 12, 30, 0, 0, 0, 0, time.Local).AddDate(0, 0, int(serial)), nil
+	}
+	return time.Time{}, fmt.Errorf("date invalide %q, formats acceptés : AAAA-MM-JJ ou JJ/MM/AAAA", value)
+}
+
+func formatStockDate(date time.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.Format("2006-01-02")
+}
+
 func splitExcelValue(value string, sep string) []string {
 	splitValue := strings.Split(value, sep)
 	trimmedValue := mapSlice(splitValue, strings.TrimSpace)
 	return selectSlice(trimmedValue, func(s string) bool { return s != "" })
 }
 
-func loadExcel(excelFileName string) (Users, map[string]Roles, error) {
-
-	xlFile, err := xlsx.OpenFile(excelFileName)
+// loadExcel reads users and zones from the stock file, as xlsx, ods or csv according to its extension
+func loadExcel(excelFileName string, options stockOptions) (Users, map[string]Roles, error) {
+	wb, err := readWorkbook(excelFileName, options)
 	if err != nil {
 		return nil, nil, err
 	}
-	err = checkExcelFormat(xlFile)
+	err = checkExcelFormat(wb, options)
 	if err != nil {
 		return nil, nil, err
 	}
-	var table [][]string
-	var zones [][]string
-	for _, sheet := range xlFile.Sheets {
-
-		if sheet.Name == NOM_PREMIERE_PAGE {
-			table = loadSheet(*sheet)
-		}
-		if sheet.Name == "zones" {
-			zones = loadSheet(*sheet)
-		}
+	table := wb[0].rows
+	zonesSheet, found := wb.sheet("zones")
+	if !found || len(zonesSheet.rows) == 0 {
+		return nil, nil, InvalidExcelFileError{msg: "la page zones est absente ou vide"}
 	}
+	zones := zonesSheet.rows
+	duplicates := options.duplicates
 
 	users := make(Users)
 
-	fields := make(map[string]int)
-	for i, f := range table[0] {
-		fields[f] = i
-	}
+	fields := columnsOf(table[0])
 
-	zoneFields := make(map[string]int)
-	for i, f := range zones[0] {
-		zoneFields[f] = i
-	}
+	zoneFields := columnsOf(zones[0])
 
-	for _, userRow := range table[1:] {
-		niveau := userRow[fields["NIVEAU HABILITATION"]]
-		email := Username(strings.TrimSpace(strings.ToLower(userRow[fields["ADRESSE MAIL"]])))
+	userRows := make(map[Username][]int)
+	var duplicateErrors []error
+	var dateErrors []error
+	for _, numberedRow := range table[1:] {
+		niveau := numberedRow.get(fields, "NIVEAU HABILITATION")
+		email := Username(strings.TrimSpace(strings.ToLower(numberedRow.get(fields, "ADRESSE MAIL"))))
+		prenom := numberedRow.get(fields, "PRENOM")
 
-		if email != "" && len(userRow[fields["PRENOM"]]) > 1 {
+		if email != "" && len(prenom) > 1 {
 			user := User{
 				niveau:            strings.ToLower(niveau),
 				email:             email,
-				nom:               strings.ToUpper(userRow[fields["NOM"]]),
-				prenom:            strings.ToUpper(userRow[fields["PRENOM"]][0:1]) + strings.ToLower(userRow[fields["PRENOM"]][1:]),
-				segment:           userRow[fields["SEGMENT"]],
-				fonction:          userRow[fields["FONCTION"]],
-				employeur:         userRow[fields["ENTITES"]],
-				goup:              userRow[fields["GOUP"]],
-				accesGeographique: userRow[fields["ACCES GEOGRAPHIQUE"]],
-				scope:             splitExcelValue(userRow[fields["SCOPE"]], ","),
-				boards:            splitExcelValue(userRow[fields["BOARDS"]], ","),
-				taskforces:        splitExcelValue(userRow[fields["TASKFORCE"]], ","),
+				nom:               strings.ToUpper(numberedRow.get(fields, "NOM")),
+				prenom:            strings.ToUpper(prenom[0:1]) + strings.ToLower(prenom[1:]),
+				segment:           numberedRow.get(fields, "SEGMENT"),
+				fonction:          numberedRow.get(fields, "FONCTION"),
+				employeur:         numberedRow.get(fields, "ENTITES"),
+				goup:              numberedRow.get(fields, "GOUP"),
+				accesGeographique: numberedRow.get(fields, "ACCES GEOGRAPHIQUE"),
+				scope:             splitExcelValue(numberedRow.get(fields, "SCOPE"), ","),
+				boards:            splitExcelValue(numberedRow.get(fields, "BOARDS"), ","),
+				taskforces:        splitExcelValue(numberedRow.get(fields, "TASKFORCE"), ","),
+				realmRoles:        splitExcelValue(numberedRow.get(fields, "ROLES REALM"), ","),
+				groups:            splitGroupPaths(numberedRow.get(fields, "GROUPES")),
+			}
+			if user.debut, err = parseStockDate(numberedRow.get(fields, "DEBUT")); err != nil {
+				dateErrors = append(dateErrors, StockError{NOM_PREMIERE_PAGE, numberedRow.number, "DEBUT", err.Error()})
+			}
+			if user.fin, err = parseStockDate(numberedRow.get(fields, "FIN")); err != nil {
+				dateErrors = append(dateErrors, StockError{NOM_PREMIERE_PAGE, numberedRow.number, "FIN", err.Error()})
+			}
+			for column, attribute := range options.extraColumns {
+				if value := strings.TrimSpace(numberedRow.get(fields, column)); value != "" {
+					if user.attributes == nil {
+						user.attributes = make(map[string]string)
+					}
+					user.attributes[attribute] = value
+				}
 			}
 
-			users[email] = user
+			userRows[email] = append(userRows[email], numberedRow.number)
+			existing, found := users[email]
+			switch {
+			case !found || duplicates == duplicatesLast:
+				users[email] = user
+			case duplicates == duplicatesMerge:
+				merged, conflicts := existing.merge(user)
+				if len(conflicts) > 0 {
+					duplicateErrors = append(duplicateErrors, DuplicateUserError{
+						email: email,
+						rows:  userRows[email],
+						msg:   "valeurs différentes pour " + strings.Join(conflicts, ", "),
+					})
+				}
+				users[email] = merged
+			}
+		}
+	}
+	for _, email := range sortedKeys(userRows) {
+		if len(userRows[email]) < 2 {
+			continue
+		}
+		if duplicates == duplicatesError {
+			duplicateErrors = append(duplicateErrors, DuplicateUserError{email: email, rows: userRows[email]})
+		} else {
+			logger.Warn("adresse mail en double", logger.ContextForMethod(loadExcel).
+				AddAny("email", email).
+				AddAny("rows", userRows[email]).
+				AddString("strategy", string(duplicates)))
+		}
+	}
+	if len(dateErrors) > 0 {
+		return nil, nil, InvalidExcelFileError{
+			msg: fmt.Sprintf("%d date(s) invalide(s) dans le fichier stock", len(dateErrors)),
+			err: joinErrors(dateErrors),
+		}
+	}
+	if len(duplicateErrors) > 0 {
+		return nil, nil, InvalidExcelFileError{
+			msg: fmt.Sprintf("%d adresse(s) mail en double dans le fichier stock", len(duplicateErrors)),
+			err: joinErrors(duplicateErrors),
 		}
 	}
 	compositeRoles := make(map[string]Roles)
 	for _, z := range zones[1:] {
-		compositeRoles[z[zoneFields["REGION"]]] = append(
-			compositeRoles[z[zoneFields["REGION"]]],
-			z[zoneFields["DEPARTEMENT"]],
-		)
-		compositeRoles[z[zoneFields["ANCIENNE REGION"]]] = append(
-			compositeRoles[z[zoneFields["ANCIENNE REGION"]]],
-			z[zoneFields["DEPARTEMENT"]],
-		)
+		for _, zone := range []string{z.get(zoneFields, "REGION"), z.get(zoneFields, "ANCIENNE REGION")} {
+			// former region is empty for departements of a single zone
+			if zone == "" {
+				continue
+			}
+			compositeRoles[zone] = append(compositeRoles[zone], z.get(zoneFields, "DEPARTEMENT"))
+		}
 	}
 	return users, compositeRoles, nil
 }
 
-func checkExcelFormat(file *xlsx.File) error {
-	return checkSheet1Format(file.Sheets[0])
+// withCanonicalZones spells the geographic access and the zone scopes of users as the zones they grant,
+// validation accepts zones whatever their case but roles are case sensitive
+func (users Users) withCanonicalZones(compositeRoles CompositeRoles) Users {
+	zonesCase := canonicalZones(compositeRoles)
+	canonical := make(Users, len(users))
+	for email, user := range users {
+		user.accesGeographique = zonesCase.of(user.accesGeographique)
+		if user.scope != nil {
+			user.scope = mapSlice(user.scope, zonesCase.of)
+		}
+		canonical[email] = user
+	}
+	return canonical
 }
 
-func checkSheet1Format(sheet *xlsx.Sheet) error {
-	if sheet.Name != NOM_PREMIERE_PAGE {
-		return InvalidExcelFileError{msg: fmt.Sprintf("la première page n'a pas le bon nom (%s) : %s", NOM_PREMIERE_PAGE, sheet.Name)}
-	}
+// zoneSpellings maps each lowercased zone and departement to its spelling
+type zoneSpellings map[string]string
 
-	firstRow, err := sheet.Row(0)
-	if err != nil {
-		return InvalidExcelFileError{msg: "erreur lors de la récupération des headers", err: err}
-	}
-	for i := 0; i < len(HEADERS); i++ {
-		cell := firstRow.GetCell(i)
-		actual := cell.Value
-		expected := HEADERS[i]
-		if actual != expected {
-			return InvalidExcelFileError{
-				msg: fmt.Sprintf("l'entête %s en position %d ne correspond pas à la valeur attendue %s", actual, i, expected),
+// canonicalZones spells zones as in the zones sheet, or else as in the referentiel
+func canonicalZones(compositeRoles CompositeRoles) zoneSpellings {
+	spellings := make(zoneSpellings)
+	for _, zones := range []CompositeRoles{referentiel.toRoles(), compositeRoles} {
+		for zone, departements := range zones {
+			spellings[strings.ToLower(zone)] = zone
+			for _, departement := range departements {
+				spellings[strings.ToLower(departement)] = departement
 			}
 		}
 	}
-	return nil
+	return spellings
 }
 
-func loadSheet(sheet xlsx.Sheet) [][]string {
-	var r [][]string
-	_ = sheet.ForEachRow(func(row *xlsx.Row) error {
-		var line []string
-		_ = row.ForEachCell(func(cell *xlsx.Cell) error {
-			line = append(line, cell.Value)
-			return nil
-		})
-		if isNotEmpty(line) {
-			r = append(r, line)
-		}
-		return nil
+// of returns the canonical spelling of a zone, other values are returned unchanged
+func (spellings zoneSpellings) of(value string) string {
+	if zone, found := spellings[strings.ToLower(value)]; found {
+		return zone
+	}
+	return value
+}
+
+// checkExcelFormat checks the first sheet, whatever the stock file format
+func checkExcelFormat(wb workbook, options stockOptions) error {
+	return checkSheet1Format(wb[0], options)
+}
+
+// checkSheet1Format checks that each expected header is present, in any order
+func checkSheet1Format(sheet sheet, options stockOptions) error {
+	if sheet.name != NOM_PREMIERE_PAGE {
+		return InvalidExcelFileError{msg: fmt.Sprintf("la première page n'a pas le bon nom (%s) : %s", NOM_PREMIERE_PAGE, sheet.name)}
+	}
+	if len(sheet.rows) == 0 || sheet.rows[0].number != 1 {
+		return InvalidExcelFileError{msg: "les entêtes doivent figurer sur la première ligne"}
+	}
+	columns := columnsOf(sheet.rows[0])
+	expected := append(slices.Clone(HEADERS), sortedKeys(options.extraColumns)...)
+	missing := selectSlice(expected, func(header string) bool {
+		_, found := columns[header]
+		return !found
 	})
-	return r
+	if len(missing) > 0 {
+		return InvalidExcelFileError{msg: fmt.Sprintf("entête(s) absente(s) de la première page : %s", strings.Join(missing, ", "))}
+	}
+	return nil
 }
 
 func isNotEmpty(array []string) bool {
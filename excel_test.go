@@ -2,20 +2,179 @@ package main
 
 import (
 	"fmt"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/cnf/structhash"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+
+	"keycloakUpdater/v2/pkg/structs"
 )
 
 func Test_readExcel(t *testing.T) {
 	ass := assert.New(t)
-	users, rolesMap, err := loadExcel("./userBase.xlsx")
+	users, rolesMap, err := loadExcel("./userBase.xlsx", defaultStockOptions)
 	ass.NoError(err)
 
 	hashUsers := fmt.Sprintf("%x", structhash.Md5(users, 1))
-	ass.Equal("ed87c55be7c75632fbf8dd5e9df3e94e", hashUsers)
+	ass.Equal("351490fc8aa2b23912bea8dcce152e70", hashUsers)
 
 	hashRolesMap := fmt.Sprintf("%x", structhash.Md5(rolesMap, 1))
 	ass.Equal("0fc072173fd22e567dbe26c474ea2547", hashRolesMap)
 }
+
+func Test_loadExcel_duplicates(t *testing.T) {
+	ass := assert.New(t)
+	filename := writeTestStock(t, [][]string{
+		{"A", "DGFIP", "Bretagne", "", "", "Raymond", "DUPONT", "raymond@example.com", "", "wekan", "tableau-crp-bfc", ""},
+		{"A", "DGFIP", "", "", "", "Josette", "DUPONT", "josette@example.com", "", "", "", ""},
+		{"A", "DGFIP", "Bretagne", "", "", "Raymond", "DUPONT", " Raymond@Example.com ", "", "crp", "tableau-codefi-nord", ""},
+	}, nil)
+
+	_, _, err := loadExcel(filename, defaultStockOptions)
+	ass.ErrorAs(err, &InvalidExcelFileError{})
+	ass.ErrorContains(err, "1 adresse(s) mail en double")
+	ass.EqualError(errors.Unwrap(err), "l'adresse raymond@example.com est présente lignes 2, 4")
+
+	users, _, err := loadExcel(filename, stockOptions{duplicates: duplicatesFirst})
+	ass.NoError(err)
+	ass.Equal([]string{"wekan"}, users["raymond@example.com"].scope)
+
+	users, _, err = loadExcel(filename, stockOptions{duplicates: duplicatesLast})
+	ass.NoError(err)
+	ass.Equal([]string{"crp"}, users["raymond@example.com"].scope)
+
+	users, _, err = loadExcel(filename, stockOptions{duplicates: duplicatesMerge})
+	ass.NoError(err)
+	ass.Equal([]string{"wekan", "crp"}, users["raymond@example.com"].scope)
+	ass.Equal([]string{"tableau-crp-bfc", "tableau-codefi-nord"}, users["raymond@example.com"].boards)
+	ass.Len(users, 2)
+}
+
+func Test_loadExcel_merge_refuses_conflicting_rows(t *testing.T) {
+	ass := assert.New(t)
+	filename := writeTestStock(t, [][]string{
+		{"A", "DGFIP", "", "", "", "Raymond", "DUPONT", "raymond@example.com", "", "", "", ""},
+		{"B", "DGFIP", "", "", "", "Raymond", "DUPONT", "raymond@example.com", "", "", "", ""},
+	}, nil)
+
+	_, _, err := loadExcel(filename, stockOptions{duplicates: duplicatesMerge})
+
+	ass.EqualError(errors.Unwrap(err), "l'adresse raymond@example.com est présente lignes 2, 3 : valeurs différentes pour NIVEAU HABILITATION")
+}
+
+func Test_parseDuplicatesStrategy(t *testing.T) {
+	ass := assert.New(t)
+	strategy, err := parseDuplicatesStrategy("")
+	ass.NoError(err)
+	ass.Equal(duplicatesError, strategy)
+	strategy, err = parseDuplicatesStrategy("Merge")
+	ass.NoError(err)
+	ass.Equal(duplicatesMerge, strategy)
+	_, err = parseDuplicatesStrategy("fusion")
+	ass.Error(err)
+}
+
+func Test_loadExcel_matches_headers_by_name(t *testing.T) {
+	ass := assert.New(t)
+	header := []string{"Email", "PRENOM", "NOM", "NIVEAU HABILITATION", "ENTITES", "ACCES GEOGRAPHIQUE", "FONCTION",
+		"SEGMENT", "GOUP", "SCOPE", "BOARDS", "TASKFORCE", "Téléphone", "COMMENTAIRE"}
+	filename := writeTestStockWithHeader(t, header, [][]string{
+		{"raymond@example.com", "Raymond", "DUPONT", "A", "DGFIP", "Bretagne", "", "", "", "wekan", "", "", "01 02 03 04 05", "ignoré"},
+		{"josette@example.com", "Josette", "DUPONT", "B", "DGFIP", "", "", "", "", "", "", "", "", ""},
+	}, nil)
+	options, err := stockOptionsFromConfig(structs.Stock{
+		HeaderAliases: map[string]string{"email": "ADRESSE MAIL"},
+		ExtraColumns:  map[string]string{"téléphone": "telephone"},
+	})
+	ass.NoError(err)
+
+	users, _, err := loadExcel(filename, options)
+
+	ass.NoError(err)
+	ass.Equal(User{
+		niveau:            "a",
+		email:             "raymond@example.com",
+		prenom:            "Raymond",
+		nom:               "DUPONT",
+		employeur:         "DGFIP",
+		accesGeographique: "Bretagne",
+		scope:             []string{"wekan"},
+		attributes:        map[string]string{"telephone": "01 02 03 04 05"},
+	}, users["raymond@example.com"])
+	ass.Equal([]string{"01 02 03 04 05"}, (*users["raymond@example.com"].ToGocloakUser().Attributes)["telephone"])
+	ass.Nil(users["josette@example.com"].attributes)
+
+	_, _, err = loadExcel(filename, defaultStockOptions)
+	ass.ErrorAs(err, &InvalidExcelFileError{})
+	ass.ErrorContains(err, "entête(s) absente(s) de la première page : ADRESSE MAIL")
+}
+
+func Test_stockOptionsFromConfig_checks_columns(t *testing.T) {
+	ass := assert.New(t)
+	_, err := stockOptionsFromConfig(structs.Stock{HeaderAliases: map[string]string{"EMAIL": "COURRIEL"}})
+	ass.ErrorContains(err, "l'alias EMAIL désigne une colonne inconnue : COURRIEL")
+	_, err = stockOptionsFromConfig(structs.Stock{ExtraColumns: map[string]string{"NOM": "nom"}})
+	ass.ErrorContains(err, "la colonne supplémentaire NOM est déjà une colonne du stock")
+	_, err = stockOptionsFromConfig(structs.Stock{ExtraColumns: map[string]string{"GROUPE": "goup_path"}})
+	ass.ErrorContains(err, `attribut Keycloak invalide pour la colonne GROUPE : "goup_path"`)
+	_, err = stockOptionsFromConfig(structs.Stock{
+		HeaderAliases: map[string]string{"TEL": "Téléphone"},
+		ExtraColumns:  map[string]string{"TÉLÉPHONE": "telephone"},
+	})
+	ass.NoError(err)
+}
+
+func Test_loadExcel_reads_access_period(t *testing.T) {
+	ass := assert.New(t)
+	header := append(slices.Clone(HEADERS), "DEBUT", "FIN")
+	filename := writeTestStockWithHeader(t, header, [][]string{
+		{"A", "DGFIP", "", "", "", "Raymond", "DUPONT", "raymond@example.com", "", "", "", "", "2024-01-15", "31/01/2024"},
+		{"A", "DGFIP", "", "", "", "Josette", "DUPONT", "josette@example.com", "", "", "", "", "45292", ""},
+	}, nil)
+
+	users, _, err := loadExcel(filename, defaultStockOptions)
+
+	ass.NoError(err)
+	ass.Equal(time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local), users["raymond@example.com"].debut)
+	ass.Equal(time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local), users["raymond@example.com"].fin)
+	ass.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local), users["josette@example.com"].debut)
+	ass.True(users["josette@example.com"].fin.IsZero())
+}
+
+func Test_validateExcel_checks_access_period(t *testing.T) {
+	ass := assert.New(t)
+	header := append(slices.Clone(HEADERS), "DEBUT", "FIN")
+	filename := writeTestStockWithHeader(t, header, [][]string{
+		{"A", "DGFIP", "", "", "", "Raymond", "DUPONT", "raymond@example.com", "", "", "", "", "demain", "2024-01-31"},
+		{"A", "DGFIP", "", "", "", "Josette", "DUPONT", "josette@example.com", "", "", "", "", "2024-02-01", "2024-01-31"},
+	}, nil)
+
+	stockErrors, err := validateExcel(filename, defaultStockOptions, newStockRules(defaultHabilitations, nil, nil))
+
+	ass.NoError(err)
+	ass.Equal([]StockError{
+		{NOM_PREMIERE_PAGE, 2, "DEBUT", `date invalide "demain", formats acceptés : AAAA-MM-JJ ou JJ/MM/AAAA`},
+		{NOM_PREMIERE_PAGE, 3, "FIN", "fin d'accès 2024-01-31 antérieure au début 2024-02-01"},
+	}, stockErrors)
+	_, _, err = loadExcel(filename, defaultStockOptions)
+	ass.ErrorContains(err, "1 date(s) invalide(s) dans le fichier stock")
+}
+
+func Test_withCanonicalZones_spells_zones_as_their_roles(t *testing.T) {
+	ass := assert.New(t)
+	filename := writeTestStock(t, [][]string{
+		{"A", "DGFIP", "bretagne", "", "", "Raymond", "DUPONT", "raymond@example.com", "", "zone PERSO,wekan", "", ""},
+	}, [][]string{{"Zone perso", "Zone perso", "999"}})
+	users, compositeRoles, err := loadExcel(filename, defaultStockOptions)
+	ass.NoError(err)
+
+	user := users.withCanonicalZones(compositeRoles)["raymond@example.com"]
+
+	ass.Equal("Bretagne", user.accesGeographique)
+	ass.Equal([]string{"Zone perso", "wekan"}, user.scope)
+	ass.Contains(user.getRoles(defaultHabilitations), "Bretagne")
+	ass.Equal("bretagne", users["raymond@example.com"].accesGeographique)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/pkg/errors"
+	"github.com/tealeg/xlsx/v3"
+
+	"keycloakUpdater/v2/pkg/logger"
+)
+
+var ZONES_HEADERS = []string{"REGION", "ANCIENNE REGION", "DEPARTEMENT"}
+
+// exportKeycloak rebuilds enabled users and geographic zones from Keycloak,
+// the attributes of extraColumns are read as in the stock
+func exportKeycloak(kc KeycloakContext, clientID string, extraColumns map[string]string) (Users, CompositeRoles, error) {
+	logContext := logger.ContextForMethod(exportKeycloak).AddString("clientId", clientID)
+	internalID, err := kc.GetInternalIDFromClientID(clientID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	compositeRoles := make(CompositeRoles)
+	for _, role := range kc.ClientRoles[clientID] {
+		if role.Composite == nil || !*role.Composite {
+			continue
+		}
+		composites, err := kc.API.GetCompositeClientRolesByRoleID(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalID, *role.ID)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "erreur pendant la lecture des rôles composites de %s", *role.Name)
+		}
+		compositeRoles[*role.Name] = rolesFromGocloakRoles(composites)
+	}
+
+	users := make(Users)
+	for _, kcUser := range kc.Users {
+		if kcUser.Username == nil || kcUser.Enabled == nil || !*kcUser.Enabled {
+			continue
+		}
+		roles, err := kc.API.GetClientRolesByUserID(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalID, *kcUser.ID)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "erreur pendant la lecture des rôles de %s", *kcUser.Username)
+		}
+		user := userFromKeycloak(*kcUser, rolesFromGocloakRoles(roles), compositeRoles, kc.Habilitations, extraColumns)
+		otherRoles, err := kc.otherClientsRolesOf(clientID, *kcUser.ID)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "erreur pendant la lecture des rôles de %s", *kcUser.Username)
+		}
+		user.scope = append(user.scope, otherRoles...)
+		if user.realmRoles, user.groups, err = kc.membershipsOf(context.Background(), *kcUser.ID); err != nil {
+			return nil, nil, errors.Wrapf(err, "erreur pendant la lecture des rôles du realm et des groupes de %s", *kcUser.Username)
+		}
+		if len(user.prenom) < 2 {
+			logger.Warn("prénom absent, l'utilisateur sera ignoré à la relecture du stock", logContext.Clone().AddUser(*kcUser))
+		}
+		users[user.email] = user
+	}
+	logger.Info("état de Keycloak exporté", logContext.AddInt("users", len(users)).AddInt("zones", len(compositeRoles)))
+	return users, compositeRoles, nil
+}
+
+// otherClientsRolesOf returns the user roles in managed clients other than the default client, as client:role
+func (kc KeycloakContext) otherClientsRolesOf(defaultClient string, userID string) (Roles, error) {
+	var roles Roles
+	for _, client := range kc.roleClients(defaultClient)[1:] {
+		internalID, err := kc.GetInternalIDFromClientID(client)
+		if err != nil {
+			return nil, err
+		}
+		clientRoles, err := kc.API.GetClientRolesByUserID(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalID, userID)
+		if err != nil {
+			return nil, err
+		}
+		sorted := rolesFromGocloakRoles(clientRoles)
+		slices.Sort(sorted)
+		roles = append(roles, qualifiedRoles(client, defaultClient, sorted)...)
+	}
+	return roles, nil
+}
+
+// userFromKeycloak finds the level, geographic access and scope of a user from its roles,
+// and its extra attributes from the Keycloak attributes of extraColumns
+func userFromKeycloak(kcUser gocloak.User, roles Roles, compositeRoles CompositeRoles, habilitations CompositeRoles, extraColumns map[string]string) User {
+	user := User{
+		email:     Username(strings.ToLower(stringOrEmpty(kcUser.Username))),
+		prenom:    stringOrEmpty(kcUser.FirstName),
+		nom:       stringOrEmpty(kcUser.LastName),
+		fonction:  firstAttribute(kcUser, "fonction"),
+		employeur: firstAttribute(kcUser, "employeur"),
+		segment:   firstAttribute(kcUser, "segment"),
+		goup:      firstAttribute(kcUser, "goup_path"),
+	}
+	for _, attribute := range extraColumns {
+		if value := firstAttribute(kcUser, attribute); value != "" {
+			if user.attributes == nil {
+				user.attributes = make(map[string]string)
+			}
+			user.attributes[attribute] = value
+		}
+	}
+	user.niveau, roles = niveauFromRoles(roles, habilitations)
+	slices.Sort(roles)
+	var scope Roles
+	for _, role := range roles {
+		// geographic access is only given to users with a habilitation level
+		if user.niveau != "" && user.accesGeographique == "" && isZone(role, compositeRoles) {
+			user.accesGeographique = role
+			continue
+		}
+		scope.add(role)
+	}
+	user.scope = scope
+	return user
+}
+
+// niveauFromRoles returns the widest habilitation level covered by roles, and the remaining roles
+func niveauFromRoles(roles Roles, habilitations CompositeRoles) (string, Roles) {
+	niveaux := keys(habilitations)
+	slices.SortFunc(niveaux, func(a, b string) int {
+		if len(habilitations[a]) != len(habilitations[b]) {
+			return len(habilitations[b]) - len(habilitations[a])
+		}
+		return strings.Compare(a, b)
+	})
+	for _, niveau := range niveaux {
+		_, missing, _ := intersect(habilitations[niveau], roles)
+		if len(missing) == 0 {
+			return niveau, selectSlice(roles, func(role string) bool { return !habilitations[niveau].contains(role) })
+		}
+	}
+	return "", roles
+}
+
+func isZone(role string, compositeRoles CompositeRoles) bool {
+	if _, ok := compositeRoles[role]; ok {
+		return true
+	}
+	for _, departements := range compositeRoles {
+		if departements.contains(role) {
+			return true
+		}
+	}
+	return false
+}
+
+func firstAttribute(kcUser gocloak.User, key string) string {
+	if kcUser.Attributes == nil || len((*kcUser.Attributes)[key]) == 0 {
+		return ""
+	}
+	return (*kcUser.Attributes)[key][0]
+}
+
+// zonesRows rebuilds the rows of the zones sheet, the region is the widest zone containing the departement
+func zonesRows(compositeRoles CompositeRoles) [][]string {
+	sizes := make(map[string]int)
+	zonesByDepartement := make(map[string]Roles)
+	for zone, departements := range compositeRoles {
+		var distinct Roles
+		distinct.add(departements...)
+		sizes[zone] = len(distinct)
+		for _, departement := range distinct {
+			zones := zonesByDepartement[departement]
+			zones.add(zone)
+			zonesByDepartement[departement] = zones
+		}
+	}
+	var rows [][]string
+	for _, departement := range sortedKeys(zonesByDepartement) {
+		zones := zonesByDepartement[departement]
+		slices.SortFunc(zones, func(a, b string) int {
+			if sizes[a] != sizes[b] {
+				return sizes[b] - sizes[a]
+			}
+			return strings.Compare(a, b)
+		})
+		// a departement of a single zone has no former region, the zone isn't repeated
+		ancienneRegion := ""
+		if len(zones) > 1 {
+			ancienneRegion = zones[len(zones)-1]
+		}
+		rows = append(rows, []string{zones[0], ancienneRegion, departement})
+	}
+	slices.SortFunc(rows, func(a, b []string) int {
+		return strings.Compare(strings.Join(a, "\t"), strings.Join(b, "\t"))
+	})
+	return rows
+}
+
+// excelRow returns the user row in the order of stockHeaders, followed by the extra columns of options
+func (user User) excelRow(options stockOptions) []string {
+	values := map[string]string{
+		"NIVEAU HABILITATION": strings.ToUpper(user.niveau),
+		"ENTITES":             user.employeur,
+		"ACCES GEOGRAPHIQUE":  user.accesGeographique,
+		"FONCTION":            user.fonction,
+		"SEGMENT":             user.segment,
+		"PRENOM":              user.prenom,
+		"NOM":                 user.nom,
+		"ADRESSE MAIL":        string(user.email),
+		"GOUP":                user.goup,
+		"SCOPE":               strings.Join(user.scope, ","),
+		"BOARDS":              strings.Join(user.boards, ","),
+		"TASKFORCE":           strings.Join(user.taskforces, ","),
+		"DEBUT":               formatStockDate(user.debut),
+		"FIN":                 formatStockDate(user.fin),
+		"ROLES REALM":         strings.Join(user.realmRoles, ","),
+		"GROUPES":             strings.Join(user.groups, ","),
+	}
+	for column, attribute := range options.extraColumns {
+		values[column] = user.attributes[attribute]
+	}
+	return mapSlice(excelHeaders(options), func(header string) string { return values[header] })
+}
+
+// excelHeaders returns stockHeaders followed by the extra columns of options
+func excelHeaders(options stockOptions) []string {
+	return append(stockHeaders(), sortedKeys(options.extraColumns)...)
+}
+
+// writeExcel writes users and zones to a file that loadExcel can read with the same options
+func writeExcel(filename string, users Users, compositeRoles CompositeRoles, options stockOptions) error {
+	file := xlsx.NewFile()
+	sheet, err := file.AddSheet(NOM_PREMIERE_PAGE)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	addRow(sheet, excelHeaders(options))
+	for _, username := range sortedKeys(users) {
+		addRow(sheet, users[username].excelRow(options))
+	}
+	zones, err := file.AddSheet("zones")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	addRow(zones, ZONES_HEADERS)
+	for _, row := range zonesRows(compositeRoles) {
+		addRow(zones, row)
+	}
+	return errors.WithStack(file.Save(filename))
+}
+
+func addRow(sheet *xlsx.Sheet, values []string) {
+	row := sheet.AddRow()
+	for _, value := range values {
+		row.AddCell().SetString(value)
+	}
+}
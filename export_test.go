@@ -0,0 +1,133 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+func Test_writeExcel_can_be_read_by_loadExcel(t *testing.T) {
+	ass := assert.New(t)
+	users, compositeRoles, err := loadExcel("./userBase.xlsx", defaultStockOptions)
+	ass.NoError(err)
+	filename := filepath.Join(t.TempDir(), "export.xlsx")
+
+	ass.NoError(writeExcel(filename, users, compositeRoles, defaultStockOptions))
+	exportedUsers, exportedCompositeRoles, err := loadExcel(filename, defaultStockOptions)
+
+	ass.NoError(err)
+	ass.Equal(sortedKeys(users), sortedKeys(exportedUsers))
+	for username, user := range users {
+		ass.ElementsMatch(user.getRoles(defaultHabilitations), exportedUsers[username].getRoles(defaultHabilitations))
+	}
+	for zone, departements := range compositeRoles {
+		var expected, actual Roles
+		expected.add(departements...)
+		actual.add(exportedCompositeRoles[zone]...)
+		ass.ElementsMatch(expected, actual, zone)
+	}
+}
+
+func Test_userFromKeycloak(t *testing.T) {
+	ass := assert.New(t)
+	username, prenom, nom := "Raymond.Dupont@example.com", "Raymond", "DUPONT"
+	attributes := map[string][]string{"fonction": {"chargé de mission"}, "employeur": {"DGFIP"}, "goup_path": {"dgfip"}}
+	kcUser := gocloak.User{Username: &username, FirstName: &prenom, LastName: &nom, Attributes: &attributes}
+	roles := Roles{"bdf", "detection", "dgefp", "pge", "score", "urssaf", "Bretagne", "wekan"}
+	compositeRoles := CompositeRoles{"Bretagne": {"22", "29", "35", "56"}}
+
+	user := userFromKeycloak(kcUser, roles, compositeRoles, defaultHabilitations, nil)
+
+	ass.Equal(Username("raymond.dupont@example.com"), user.email)
+	ass.Equal("a", user.niveau)
+	ass.Equal("Bretagne", user.accesGeographique)
+	ass.Equal([]string{"wekan"}, user.scope)
+	ass.Equal("DGFIP", user.employeur)
+	ass.Equal("dgfip", user.goup)
+	expected, actual := slices.Clone(roles), user.getRoles(defaultHabilitations)
+	slices.Sort(expected)
+	slices.Sort(actual)
+	ass.Equal(expected, actual)
+}
+
+func Test_niveauFromRoles_without_habilitation(t *testing.T) {
+	ass := assert.New(t)
+	niveau, roles := niveauFromRoles(Roles{"detection", "wekan"}, defaultHabilitations)
+	ass.Equal("", niveau)
+	ass.Equal(Roles{"detection", "wekan"}, roles)
+}
+
+func Test_withWekanMemberships(t *testing.T) {
+	ass := assert.New(t)
+	users := Users{
+		"raymond@example.com": {email: "raymond@example.com", scope: []string{"wekan"}, boards: []string{"ancien-tableau"}},
+		"josette@example.com": {email: "josette@example.com", scope: []string{"wekan"}},
+	}
+	boards := map[Username][]string{
+		"raymond@example.com": {"tableau-crp-bfc", "tableau-codefi-nord", "tableau-crp-bfc"},
+		"inconnu@example.com": {"tableau-crp-bfc"},
+	}
+	taskforces := map[Username][]string{"raymond@example.com": {"labelle_bleue"}}
+
+	exported := withWekanMemberships(users, boards, taskforces)
+
+	ass.Len(exported, 2)
+	ass.Equal([]string{"tableau-codefi-nord", "tableau-crp-bfc"}, exported["raymond@example.com"].boards)
+	ass.Equal([]string{"labelle_bleue"}, exported["raymond@example.com"].taskforces)
+	ass.Empty(exported["josette@example.com"].boards)
+	ass.Equal([]string{"ancien-tableau"}, users["raymond@example.com"].boards)
+}
+
+func Test_writeExcel_then_loadExcel_keeps_compositeRoles(t *testing.T) {
+	ass := assert.New(t)
+	compositeRoles := CompositeRoles{
+		"Grand Est":         {"08", "10", "67", "68"},
+		"Alsace":            {"67", "68"},
+		"Champagne-Ardenne": {"08", "10"},
+		"Zone perso":        {"999"},
+	}
+	users := Users{"raymond@example.com": {niveau: "a", email: "raymond@example.com", prenom: "Raymond", nom: "DUPONT", accesGeographique: "Alsace"}}
+	filename := filepath.Join(t.TempDir(), "export.xlsx")
+
+	ass.NoError(writeExcel(filename, users, compositeRoles, defaultStockOptions))
+	_, exported, err := loadExcel(filename, defaultStockOptions)
+
+	ass.NoError(err)
+	for _, departements := range exported {
+		slices.Sort(departements)
+	}
+	ass.Equal(compositeRoles, CompositeRoles(exported))
+}
+
+func Test_zonesRows_leaves_ancienne_region_empty_for_a_single_zone(t *testing.T) {
+	ass := assert.New(t)
+	rows := zonesRows(CompositeRoles{"Alsace": {"67"}, "Grand Est": {"67", "08"}, "Zone perso": {"999"}})
+	ass.Equal([][]string{
+		{"Grand Est", "", "08"},
+		{"Grand Est", "Alsace", "67"},
+		{"Zone perso", "", "999"},
+	}, rows)
+}
+
+func Test_writeExcel_then_loadExcel_keeps_extra_columns(t *testing.T) {
+	ass := assert.New(t)
+	options, err := stockOptionsFromConfig(structs.Stock{ExtraColumns: map[string]string{"Telephone": "phone"}})
+	ass.NoError(err)
+	username, prenom, nom := "raymond@example.com", "Raymond", "DUPONT"
+	attributes := map[string][]string{"phone": {"0102030405"}, "fonction": {"inspecteur"}}
+	kcUser := gocloak.User{Username: &username, FirstName: &prenom, LastName: &nom, Attributes: &attributes}
+	user := userFromKeycloak(kcUser, Roles{"detection", "dgefp", "pge", "score"}, CompositeRoles{}, defaultHabilitations, options.extraColumns)
+	filename := filepath.Join(t.TempDir(), "export.xlsx")
+
+	ass.NoError(writeExcel(filename, Users{user.email: user}, CompositeRoles{}, options))
+	exported, _, err := loadExcel(filename, options)
+
+	ass.NoError(err)
+	ass.Equal(map[string]string{"phone": "0102030405"}, exported[user.email].attributes)
+	ass.Equal("inspecteur", exported[user.email].fonction)
+}
@@ -7,6 +7,7 @@ require (
 	github.com/BurntSushi/toml v1.3.2
 	github.com/Nerzal/gocloak/v13 v13.9.0
 	github.com/cnf/structhash v0.0.0-20201127153200-e1b16c1ebc08
+	github.com/go-resty/resty/v2 v2.7.0
 	github.com/gosimple/slug v1.14.0
 	github.com/jaswdr/faker v1.19.1
 	github.com/ory/dockertest/v3 v3.10.0
@@ -16,6 +17,8 @@ require (
 	github.com/signaux-faibles/libwekan v0.6.0
 	github.com/stretchr/testify v1.9.0
 	github.com/tealeg/xlsx/v3 v3.3.5
+	golang.org/x/text v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -42,7 +45,6 @@ require (
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/docker/go-units v0.4.0 // indirect
 	github.com/frankban/quicktest v1.14.6 // indirect
-	github.com/go-resty/resty/v2 v2.7.0 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/google/btree v1.1.2 // indirect
@@ -75,7 +77,5 @@ require (
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
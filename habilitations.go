@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+// defaultHabilitations is the matrix used when the configuration has no [habilitations] section
+var defaultHabilitations = CompositeRoles{
+	"a": []string{"bdf", "detection", "dgefp", "pge", "score", "urssaf"},
+	"b": []string{"detection", "dgefp", "pge", "score"},
+}
+
+// resolveHabilitations builds the levels matrix from the configuration,
+// each level gets the roles of the levels it inherits from
+func resolveHabilitations(config map[string]structs.Habilitation) (CompositeRoles, error) {
+	if len(config) == 0 {
+		return defaultHabilitations, nil
+	}
+	levels := make(map[string]structs.Habilitation)
+	for niveau, habilitation := range config {
+		niveau = strings.ToLower(strings.TrimSpace(niveau))
+		if niveau == "" || niveau == "0" {
+			return nil, fmt.Errorf("le niveau d'habilitation %q est réservé aux utilisateurs sans habilitation", niveau)
+		}
+		if _, found := levels[niveau]; found {
+			return nil, fmt.Errorf("le niveau d'habilitation %s est défini plusieurs fois", niveau)
+		}
+		levels[niveau] = habilitation
+	}
+	resolved := make(CompositeRoles)
+	var resolve func(niveau string, path []string) (Roles, error)
+	resolve = func(niveau string, path []string) (Roles, error) {
+		if roles, found := resolved[niveau]; found {
+			return roles, nil
+		}
+		if contains(path, niveau) {
+			return nil, fmt.Errorf("héritage circulaire entre niveaux d'habilitation : %s", strings.Join(append(path, niveau), " → "))
+		}
+		habilitation, found := levels[niveau]
+		if !found {
+			return nil, fmt.Errorf("le niveau d'habilitation %s hérite d'un niveau inconnu : %s", path[len(path)-1], niveau)
+		}
+		var roles Roles
+		for _, parent := range habilitation.Inherits {
+			inherited, err := resolve(strings.ToLower(strings.TrimSpace(parent)), append(path, niveau))
+			if err != nil {
+				return nil, err
+			}
+			roles.add(inherited...)
+		}
+		roles.add(selectSlice(mapSlice(habilitation.Roles, strings.TrimSpace), func(role string) bool { return role != "" })...)
+		if len(roles) == 0 {
+			return nil, fmt.Errorf("le niveau d'habilitation %s ne donne aucun rôle", niveau)
+		}
+		resolved[niveau] = roles
+		return roles, nil
+	}
+	for _, niveau := range sortedKeys(levels) {
+		if _, err := resolve(niveau, nil); err != nil {
+			return nil, err
+		}
+	}
+	return resolved, nil
+}
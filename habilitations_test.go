@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+func Test_resolveHabilitations_defaults_to_levels_a_and_b(t *testing.T) {
+	ass := assert.New(t)
+	resolved, err := resolveHabilitations(nil)
+	ass.NoError(err)
+	ass.Equal(defaultHabilitations, resolved)
+}
+
+func Test_resolveHabilitations_applies_inheritance(t *testing.T) {
+	ass := assert.New(t)
+	var conf structs.Config
+	_, err := toml.Decode(`
+[habilitations.A]
+inherits = ["b"]
+roles = ["bdf", "urssaf"]
+
+[habilitations.b]
+roles = ["detection", "dgefp", "pge", "score"]
+
+[habilitations.c]
+inherits = ["a"]
+roles = ["ctrl"]
+`, &conf)
+	ass.NoError(err)
+
+	resolved, err := resolveHabilitations(conf.Habilitations)
+
+	ass.NoError(err)
+	ass.Equal(CompositeRoles{
+		"a": {"detection", "dgefp", "pge", "score", "bdf", "urssaf"},
+		"b": {"detection", "dgefp", "pge", "score"},
+		"c": {"detection", "dgefp", "pge", "score", "bdf", "urssaf", "ctrl"},
+	}, resolved)
+}
+
+func Test_resolveHabilitations_refuses_invalid_matrix(t *testing.T) {
+	ass := assert.New(t)
+	_, err := resolveHabilitations(map[string]structs.Habilitation{
+		"a": {Inherits: []string{"b"}},
+		"b": {Roles: []string{"score"}, Inherits: []string{"a"}},
+	})
+	ass.EqualError(err, "héritage circulaire entre niveaux d'habilitation : a → b → a")
+
+	_, err = resolveHabilitations(map[string]structs.Habilitation{"a": {Roles: []string{"score"}, Inherits: []string{"z"}}})
+	ass.EqualError(err, "le niveau d'habilitation a hérite d'un niveau inconnu : z")
+
+	_, err = resolveHabilitations(map[string]structs.Habilitation{"a": {}})
+	ass.EqualError(err, "le niveau d'habilitation a ne donne aucun rôle")
+
+	_, err = resolveHabilitations(map[string]structs.Habilitation{"0": {Roles: []string{"score"}}})
+	ass.Error(err)
+
+	_, err = resolveHabilitations(map[string]structs.Habilitation{"a": {Roles: []string{"score"}}, "A": {Roles: []string{"pge"}}})
+	ass.Error(err)
+}
+
+func TestUser_roles_with_configured_niveau(t *testing.T) {
+	ass := assert.New(t)
+	habilitations := CompositeRoles{"c": {"ctrl"}}
+
+	ass.Equal(Roles{"ctrl", "Bretagne", "wekan"}, User{niveau: "C", accesGeographique: "Bretagne", scope: []string{"wekan"}}.getRoles(habilitations))
+	ass.Equal(Roles{"wekan"}, User{niveau: "a", accesGeographique: "Bretagne", scope: []string{"wekan"}}.getRoles(habilitations))
+}
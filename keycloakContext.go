@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"net/http"
+	"slices"
+	"time"
 
 	"github.com/Nerzal/gocloak/v13"
 	"github.com/pkg/errors"
@@ -12,34 +15,88 @@ import (
 
 // KeycloakContext carry keycloak state
 type KeycloakContext struct {
-	API         *gocloak.GoCloak
-	JWT         *gocloak.JWT
-	Realm       *gocloak.RealmRepresentation
-	Clients     []*gocloak.Client
-	Users       []*gocloak.User
-	Roles       []*gocloak.Role
-	ClientRoles map[string][]*gocloak.Role
+	API   *gocloak.GoCloak
+	JWT   *gocloak.JWT
+	Realm *gocloak.RealmRepresentation
+	// LoginRealm is the realm of the admin user
+	LoginRealm string
+	// RealmMissing tells that the managed realm doesn't exist yet, SaveRealm creates it
+	RealmMissing bool
+	Clients      []*gocloak.Client
+	Users        []*gocloak.User
+	Roles        []*gocloak.Role
+	ClientRoles  map[string][]*gocloak.Role
+	// Groups maps the path of each realm group to its ID
+	Groups map[string]string
+	// ManagedRealmRoles and ManagedGroups are the realm roles and groups assigned from the stock
+	ManagedRealmRoles Roles
+	ManagedGroups     []string
+	// Habilitations maps each habilitation level to its roles, defaultHabilitations until configure is called
+	Habilitations CompositeRoles
+	// RoleClients are the clients, besides the default client, whose roles are assigned from the stock
+	RoleClients []string
+	// ContinueOnError keeps processing other users after an error, errors are returned at the end
+	ContinueOnError bool
+	// Retention tells when to delete disabled users
+	Retention RetentionPolicy
+	// PageSize is the number of users read per Keycloak call, defaultUsersPageSize if <= 0
+	PageSize int
+	// Concurrency is the number of users processed concurrently by CreateUsers, DisableUsers and UpdateCurrentUsers
+	Concurrency int
+	// token renews the admin token, kc.JWT.AccessToken is replaced when each request is sent
+	token *adminToken
 }
 
-func NewKeycloakContext(access *structs.Keycloak) (KeycloakContext, error) {
-	init, err := Init(access.Address, access.Realm, access.Username, access.Password)
-	return init, err
+// defaultUsersPageSize is the number of users read per call when pageSize isn't configured
+const defaultUsersPageSize = 500
+
+// Init provides a connected keycloak context object, the admin user logs into loginRealm to manage realm
+func Init(hostname, loginRealm, realm, username, password string) (KeycloakContext, error) {
+	return NewKeycloakContext(&structs.Keycloak{
+		Address:    hostname,
+		Username:   username,
+		Password:   password,
+		Realm:      realm,
+		LoginRealm: loginRealm,
+	})
 }
 
-// Init provides a connected keycloak context object
-func Init(hostname, realm, username, password string) (KeycloakContext, error) {
-	logContext := logger.ContextForMethod(Init).
-		AddString("path", hostname).
-		AddString("realm", realm).
-		AddString("user", username)
+// NewKeycloakContext logs in the admin user, or the service account, and reads the state of the managed realm
+func NewKeycloakContext(access *structs.Keycloak) (KeycloakContext, error) {
+	loginRealm := access.LoginRealm
+	if loginRealm == "" {
+		loginRealm = access.Realm
+	}
+	realm := access.Realm
+	logContext := logger.ContextForMethod(NewKeycloakContext).
+		AddString("path", access.Address).
+		AddString("loginRealm", loginRealm).
+		AddString("realm", realm)
+	if access.ClientID != "" {
+		logContext.AddString("serviceAccount", access.ClientID)
+		if access.ClientSecret == "" {
+			return KeycloakContext{}, ConfigError{err: errors.New("la clé clientSecret de la section [keycloak] est requise avec clientId")}
+		}
+	} else {
+		logContext.AddString("user", access.Username)
+	}
 
 	logger.Debug("initialize KeycloakContext", logContext.Clone().AddString("status", "START"))
-	kc := KeycloakContext{}
-	kc.API = gocloak.NewClient(hostname)
+	kc := KeycloakContext{
+		LoginRealm:    loginRealm,
+		PageSize:      access.PageSize,
+		Concurrency:   access.Concurrency,
+		Habilitations: defaultHabilitations,
+	}
+	kc.API = gocloak.NewClient(access.Address)
 	var err error
 	ctx := context.Background()
 	logger.Trace("récupère le token d'admin", logContext)
-	kc.JWT, err = kc.API.LoginAdmin(ctx, username, password, realm)
+	kc.token = newAdminToken(kc.API, *access, loginRealm)
+	renewTokenOnRequests(kc.API.RestyClient(), kc.token)
+	httpClient := kc.API.RestyClient().GetClient()
+	httpClient.Transport = newRetryTransport(httpClient.Transport, retryPolicyFromConfig(*access), kc.token)
+	kc.JWT, err = kc.token.connect(ctx)
 	if err != nil {
 		return KeycloakContext{}, err
 	}
@@ -47,35 +104,95 @@ func Init(hostname, realm, username, password string) (KeycloakContext, error) {
 	// fetch Realm
 	logger.Trace("récupère le realm", logContext)
 	kc.Realm, err = kc.API.GetRealm(ctx, kc.JWT.AccessToken, realm)
+	if isNotFound(err) {
+		// the realm will be created by the update, it has no client, user or role yet
+		logger.Warn("le realm n'existe pas", logContext)
+		kc.Realm = &gocloak.RealmRepresentation{Realm: &realm}
+		kc.RealmMissing = true
+		kc.Groups = make(map[string]string)
+		kc.ClientRoles = make(map[string][]*gocloak.Role)
+		return kc, nil
+	}
 	if err != nil {
 		return KeycloakContext{}, err
 	}
 
-	logger.Trace("synchronise les clients", logContext)
-	err = kc.refreshClients()
-	if err != nil {
+	if err = kc.refresh(logContext); err != nil {
 		return KeycloakContext{}, err
 	}
+	logger.Debug("initialize KeycloakContext", logContext.Clone().AddString("status", "END"))
+	return kc, nil
+}
+
+// refresh reloads clients, users, roles and groups of the realm
+func (kc *KeycloakContext) refresh(logContext *logger.LogContext) error {
+	logger.Trace("synchronise les clients", logContext)
+	if err := kc.refreshClients(); err != nil {
+		return err
+	}
 
 	logger.Trace("synchronise les utilisateurs", logContext)
-	err = kc.refreshUsers()
-	if err != nil {
-		return KeycloakContext{}, err
+	if err := kc.refreshUsers(); err != nil {
+		return err
 	}
 
 	logger.Trace("synchronise les rôles du Realm", logContext)
-	kc.Roles, err = kc.API.GetRealmRoles(ctx, kc.JWT.AccessToken, realm, gocloak.GetRoleParams{})
-	if err != nil {
-		return KeycloakContext{}, err
+	if err := kc.refreshRealmRoles(); err != nil {
+		return err
+	}
+
+	logger.Trace("synchronise les groupes", logContext)
+	if err := kc.refreshGroups(); err != nil {
+		return err
 	}
 
 	logger.Trace("synchronise les rôles clients", logContext)
-	err = kc.refreshClientRoles()
+	return kc.refreshClientRoles()
+}
+
+// isNotFound tells whether Keycloak answered 404
+func isNotFound(err error) bool {
+	var apiError *gocloak.APIError
+	return errors.As(err, &apiError) && apiError.Code == http.StatusNotFound
+}
+
+// adminUsername is the admin user that must be in the stock, none with a service account
+func adminUsername(access *structs.Keycloak) Username {
+	if access.ClientID != "" {
+		return ""
+	}
+	return Username(access.Username)
+}
+
+// managesLoginRealm tells whether the admin user belongs to the managed realm
+func (kc KeycloakContext) managesLoginRealm() bool {
+	return kc.LoginRealm == "" || kc.LoginRealm == kc.getRealmName()
+}
+
+// configure takes the habilitations matrix from the configuration,
+// and the retention and the managed realm roles and groups from the [stock] section
+func (kc *KeycloakContext) configure(conf structs.Config) error {
+	habilitations, err := resolveHabilitations(conf.Habilitations)
 	if err != nil {
-		return KeycloakContext{}, err
+		return ConfigError{err: errors.Wrap(err, "matrice d'habilitations invalide")}
 	}
-	logger.Debug("initialize KeycloakContext", logContext.Clone().AddString("status", "END"))
-	return kc, nil
+	kc.Habilitations = habilitations
+	kc.Retention = retentionPolicyOf(conf.Stock)
+	kc.ManagedRealmRoles, kc.ManagedGroups, kc.RoleClients = nil, nil, nil
+	if conf.Stock == nil {
+		return nil
+	}
+	kc.RoleClients = conf.Stock.RoleClients
+	kc.ManagedRealmRoles.add(conf.Stock.RealmRoles...)
+	kc.ManagedGroups = mapSlice(conf.Stock.Groups, normalizeGroupPath)
+	return nil
+}
+
+// roleClients returns the default client followed by the other clients whose roles are managed
+func (kc KeycloakContext) roleClients(defaultClient string) []string {
+	clients := Roles{defaultClient}
+	clients.add(kc.RoleClients...)
+	return clients
 }
 
 // GetRoles returns realm roles in []string
@@ -90,13 +207,15 @@ func (kc KeycloakContext) GetRoles() Roles {
 }
 
 // CreateClientRoles creates a bunch of roles in a client from a []string
-func (kc *KeycloakContext) CreateClientRoles(clientID string, roles Roles) (int, error) {
+func (kc *KeycloakContext) CreateClientRoles(clientID string, roles Roles) (created int, err error) {
 	fields := logger.ContextForMethod(kc.CreateClientRoles)
 
 	defer func() {
-		if err := kc.refreshClientRoles(); err != nil {
-			logger.Error("error refreshing client roles", fields, err)
-			panic(err)
+		if refreshErr := kc.refreshClientRoles(); refreshErr != nil {
+			logger.Error("error refreshing client roles", fields, refreshErr)
+			if err == nil {
+				err = refreshErr
+			}
 		}
 	}()
 
@@ -161,14 +280,53 @@ func (kc *KeycloakContext) refreshClients() error {
 	return err
 }
 
-// refreshUsers pulls user base from keycloak server
+// refreshUsers pulls user base from keycloak server, page by page
 func (kc *KeycloakContext) refreshUsers() error {
-	var err error
-	max := 100000
-	kc.Users, err = kc.API.GetUsers(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), gocloak.GetUsersParams{
-		Max: &max,
+	logContext := logger.ContextForMethod(kc.refreshUsers)
+	pageSize := kc.usersPageSize()
+	var users []*gocloak.User
+	for first := 0; ; first += pageSize {
+		page, err := kc.API.GetUsers(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), gocloak.GetUsersParams{
+			First: &first,
+			Max:   &pageSize,
+		})
+		if err != nil {
+			return err
+		}
+		users = append(users, page...)
+		logger.Trace("page d'utilisateurs lue", logContext.Clone().AddInt("first", first).AddInt("size", len(page)))
+		if len(page) < pageSize {
+			break
+		}
+	}
+	kc.Users = users
+	logger.Debug("utilisateurs lus", logContext.AddInt("size", len(users)))
+	return nil
+}
+
+func (kc KeycloakContext) usersPageSize() int {
+	if kc.PageSize <= 0 {
+		return defaultUsersPageSize
+	}
+	return kc.PageSize
+}
+
+// cacheUser updates the user in kc.Users after a write, without reloading every user
+func (kc *KeycloakContext) cacheUser(user gocloak.User) {
+	for i, cached := range kc.Users {
+		if cached != nil && cached.ID != nil && user.ID != nil && *cached.ID == *user.ID {
+			kc.Users[i] = &user
+			return
+		}
+	}
+	kc.Users = append(kc.Users, &user)
+}
+
+// uncacheUser removes the deleted user from kc.Users
+func (kc *KeycloakContext) uncacheUser(userID string) {
+	kc.Users = slices.DeleteFunc(kc.Users, func(cached *gocloak.User) bool {
+		return cached != nil && cached.ID != nil && *cached.ID == userID
 	})
-	return err
 }
 
 func (kc *KeycloakContext) refreshClientRoles() error {
@@ -187,101 +345,173 @@ func (kc *KeycloakContext) refreshClientRoles() error {
 
 // CreateUsers sends a slice of gocloak Users to keycloak
 func (kc *KeycloakContext) CreateUsers(users []gocloak.User, userMap Users, clientName string) error {
-	internalID, err := kc.GetInternalIDFromClientID(clientName)
+	internalIDs, err := kc.internalIDsOf(kc.roleClients(clientName))
 	if err != nil {
 		return err
 	}
 	logContext := logger.ContextForMethod(kc.CreateUsers).AddString("clientId", clientName)
-	for _, user := range users {
-		userLogContext := logContext.Clone().AddUser(user)
+	created := make([]*gocloak.User, len(users))
+	failures := kc.forEachUser(users, logContext, func(ctx context.Context, i int, user gocloak.User, logContext *logger.LogContext, failures *failures) bool {
+		userLogContext := logContext.AddUser(user)
 		logger.Notice("crée l'utilisateur Keycloak", userLogContext)
-		u, err := kc.API.CreateUser(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), user)
+		u, err := kc.API.CreateUser(ctx, kc.JWT.AccessToken, kc.getRealmName(), user)
 		if err != nil {
 			logger.Error("erreur keycloak pendant la création de l'utilisateur", userLogContext, err)
-			return err
+			return !failures.add(OperationError{"création de l'utilisateur", *user.Username, err})
 		}
 
-		configRoles := userMap[Username(*user.Username)].getRoles()
-		roles := kc.FindKeycloakRoles(clientName, configRoles)
-		userLogContext.AddRoles(roles)
-		if roles != nil {
-			logger.Notice("ajoute les rôles à l'utilisateur", userLogContext)
-			if err = kc.AddClientRolesToUser(internalID, u, roles); err != nil {
-				logger.Error("erreur pendant l'ajout des rôles à l'utilisateur", userLogContext, err)
-				return err
-			}
-		} else {
+		clientRoles := userMap[Username(*user.Username)].getClientRoles(clientName, kc.Habilitations)
+		if len(clientRoles) == 0 {
 			logger.Warn("pas de rôle à ajouter au nouvel utilisateur", userLogContext)
 		}
+		if err = kc.addClientRolesToNewUser(ctx, u, clientRoles, internalIDs, userLogContext); err != nil {
+			if failures.add(OperationError{"ajout des rôles à l'utilisateur", *user.Username, err}) {
+				return false
+			}
+		}
+		if err = kc.syncMemberships(ctx, u, userMap[Username(*user.Username)], userLogContext); err != nil {
+			logger.Error("erreur pendant l'ajout des rôles du realm et des groupes", userLogContext, err)
+			if failures.add(OperationError{"ajout des rôles du realm et des groupes", *user.Username, err}) {
+				return false
+			}
+		}
+		created[i], err = kc.API.GetUserByID(ctx, kc.JWT.AccessToken, kc.getRealmName(), u)
+		if err != nil {
+			logger.Error("erreur keycloak pendant la lecture de l'utilisateur créé", userLogContext, err)
+			return !failures.add(OperationError{"lecture de l'utilisateur créé", *user.Username, err})
+		}
+		return true
+	})
+	for _, user := range created {
+		if user != nil {
+			kc.cacheUser(*user)
+		}
 	}
+	return failures.err()
+}
 
-	err = kc.refreshUsers()
-	return err
+// addClientRolesToNewUser adds its roles in each client to a newly created user
+func (kc *KeycloakContext) addClientRolesToNewUser(ctx context.Context, userID string, clientRoles CompositeRoles, internalIDs map[string]string, logContext *logger.LogContext) error {
+	for _, client := range sortedKeys(clientRoles) {
+		roles := kc.FindKeycloakRoles(client, clientRoles[client])
+		clientLogContext := logContext.Clone().AddString("clientId", client).AddRoles(roles)
+		internalID, found := internalIDs[client]
+		if !found {
+			err := errors.Errorf("le client %s n'est pas géré par keycloakUpdater", client)
+			logger.Error("erreur pendant l'ajout des rôles à l'utilisateur", clientLogContext, err)
+			return err
+		}
+		if len(roles) == 0 {
+			continue
+		}
+		logger.Notice("ajoute les rôles à l'utilisateur", clientLogContext)
+		if err := kc.AddClientRolesToUser(ctx, internalID, userID, roles); err != nil {
+			logger.Error("erreur pendant l'ajout des rôles à l'utilisateur", clientLogContext, err)
+			return err
+		}
+	}
+	return nil
 }
 
-func (kc *KeycloakContext) AddClientRolesToUser(internalClientId, userID string, roles []gocloak.Role) error {
-	return kc.API.AddClientRolesToUser(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalClientId, userID, roles)
+// internalIDsOf resolves the internal ID of each client
+func (kc KeycloakContext) internalIDsOf(clientIDs []string) (map[string]string, error) {
+	internalIDs := make(map[string]string, len(clientIDs))
+	for _, clientID := range clientIDs {
+		internalID, err := kc.GetInternalIDFromClientID(clientID)
+		if err != nil {
+			return nil, err
+		}
+		internalIDs[clientID] = internalID
+	}
+	return internalIDs, nil
+}
+
+func (kc *KeycloakContext) AddClientRolesToUser(ctx context.Context, internalClientId, userID string, roles []gocloak.Role) error {
+	return kc.API.AddClientRolesToUser(ctx, kc.JWT.AccessToken, kc.getRealmName(), internalClientId, userID, roles)
 }
 
 // DisableUsers disables users and deletes every roles of users
 func (kc *KeycloakContext) DisableUsers(users []gocloak.User, clientName string) error {
-	internalID, err := kc.GetInternalIDFromClientID(clientName)
+	internalIDs, err := kc.internalIDsOf(kc.roleClients(clientName))
 	if err != nil {
 		return err
 	}
-	for _, u := range users {
-		if err = kc.disableUser(u, internalID); err != nil {
-			return err
+	logContext := logger.ContextForMethod(kc.DisableUsers)
+	disabled := make([]*gocloak.User, len(users))
+	failures := kc.forEachUser(users, logContext, func(ctx context.Context, i int, u gocloak.User, logContext *logger.LogContext, failures *failures) bool {
+		user, err := kc.disableUser(ctx, u, internalIDs, logContext)
+		disabled[i] = user
+		return !failures.add(err)
+	})
+	for _, user := range disabled {
+		if user != nil {
+			kc.cacheUser(*user)
 		}
 	}
-	err = kc.refreshUsers()
-	return err
+	return failures.err()
 }
 
-func (kc *KeycloakContext) disableUser(u gocloak.User, internalClientID string) error {
-	logContext := logger.ContextForMethod(kc.disableUser)
+// disableUser disables the user and removes its roles, the disabled user is returned as soon as Keycloak saved it
+func (kc KeycloakContext) disableUser(ctx context.Context, u gocloak.User, internalClientIDs map[string]string, logContext *logger.LogContext) (*gocloak.User, error) {
 	disabled := false
 	u.Enabled = &disabled
+	u.Attributes = withDisabledAt(u.Attributes, time.Now())
 	logContext.AddUser(u)
 	logger.Notice("désactive l'utilisateur", logContext)
-	err := kc.API.UpdateUser(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), u)
+	err := kc.API.UpdateUser(ctx, kc.JWT.AccessToken, kc.getRealmName(), u)
 	if err != nil {
 		logger.Error("erreur pendant la désactivation de l'utilisateur", logContext, err)
-		return err
-	}
-	roles, err := kc.API.GetClientRolesByUserID(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalClientID, *u.ID)
-	if err != nil {
-		logger.Error("erreur pendant la recherche des rôles de l'utilisateur", logContext, err)
+		return nil, OperationError{"désactivation de l'utilisateur", *u.Username, err}
 	}
-	var ro []gocloak.Role
-	for _, r := range roles {
-		ro = append(ro, *r)
+	for _, client := range sortedKeys(internalClientIDs) {
+		clientLogContext := logContext.Clone().AddString("clientId", client)
+		roles, err := kc.API.GetClientRolesByUserID(ctx, kc.JWT.AccessToken, kc.getRealmName(), internalClientIDs[client], *u.ID)
+		if err != nil {
+			logger.Error("erreur pendant la recherche des rôles de l'utilisateur", clientLogContext, err)
+		}
+		if len(roles) == 0 {
+			continue
+		}
+		var ro []gocloak.Role
+		for _, r := range roles {
+			ro = append(ro, *r)
+		}
+		clientLogContext.AddArray("roles", rolesFromGocloakRoles(roles))
+		logger.Info("supprime les rôles de l'utilisateur", clientLogContext)
+		err = kc.API.DeleteClientRolesFromUser(ctx, kc.JWT.AccessToken, kc.getRealmName(), internalClientIDs[client], *u.ID, ro)
+		if err != nil {
+			logger.Error("erreur pendant la soustraction des rôles de l'utilisateur", clientLogContext, err)
+			return &u, OperationError{"désactivation de l'utilisateur", *u.Username, err}
+		}
 	}
-	logContext.AddArray("roles", rolesFromGocloakRoles(roles))
-	logger.Info("supprime les rôles de l'utilisateur", logContext)
-	err = kc.API.DeleteClientRolesFromUser(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalClientID, *u.ID, ro)
-	if err != nil {
-		logger.Error("erreur pendant la soustraction des rôles de l'utilisateur", logContext, err)
-		return err
+	if err = kc.syncMemberships(ctx, *u.ID, User{}, logContext); err != nil {
+		logger.Error("erreur pendant le retrait des rôles du realm et des groupes", logContext, err)
+		return &u, OperationError{"désactivation de l'utilisateur", *u.Username, err}
 	}
-	return nil
+	return &u, nil
 }
 
 // EnableUsers enables users and adds roles
 func (kc *KeycloakContext) EnableUsers(users []gocloak.User) error {
 	logContext := logger.ContextForMethod(kc.EnableUsers)
 	t := true
+	failures := kc.newFailures()
 	for _, user := range users {
 		logContext.AddUser(user)
 		logger.Notice("active l'utilisateur", logContext)
 		user.Enabled = &t
+		user.Attributes = withoutDisabledAt(user.Attributes)
 		err := kc.API.UpdateUser(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), user)
 		if err != nil {
 			logger.Error("erreur pendant l'activation d'un utilisateur", logContext, err)
+			if failures.add(OperationError{"activation de l'utilisateur", *user.Username, err}) {
+				break
+			}
+			continue
 		}
+		kc.cacheUser(user)
 	}
-	err := kc.refreshUsers()
-	return err
+	return failures.err()
 }
 
 // UpdateCurrentUsers sets client roles on specified users according userMap
@@ -291,29 +521,23 @@ func (kc KeycloakContext) UpdateCurrentUsers(users []gocloak.User, userMap Users
 	if err != nil {
 		return err
 	}
-	internalID, err := kc.GetInternalIDFromClientID(clientName)
+	clients := kc.roleClients(clientName)
+	internalIDs, err := kc.internalIDsOf(clients)
 	if err != nil {
 		return err
 	}
 
-	for _, user := range users {
+	failures := kc.forEachUser(users, logContext, func(ctx context.Context, _ int, user gocloak.User, logContext *logger.LogContext, failures *failures) bool {
 		logContext.AddUser(user)
-		roles, err := kc.API.GetClientRolesByUserID(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalID, *user.ID)
+		accountPRoles, err := kc.API.GetClientRolesByUserID(ctx, kc.JWT.AccessToken, kc.getRealmName(), accountInternalID, *user.ID)
 		if err != nil {
-			return err
-		}
-		accountPRoles, err := kc.API.GetClientRolesByUserID(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), accountInternalID, *user.ID)
-		if err != nil {
-			return err
+			return !failures.add(OperationError{"lecture des rôles account de l'utilisateur", *user.Username, err})
 		}
 		accountRoles := rolesFromGocloakRoles(accountPRoles)
 
 		u := userMap[Username(*user.Username)]
-		ug := u.ToGocloakUser()
-		if user.LastName != nil && u.nom != *user.LastName ||
-			user.LastName != nil && u.prenom != *user.FirstName ||
-			!compareAttributes(user.Attributes, ug.Attributes) {
-
+		if u.differsFrom(user) {
+			ug := u.ToGocloakUser()
 			update := gocloak.User{
 				ID:         user.ID,
 				FirstName:  &u.prenom,
@@ -321,67 +545,121 @@ func (kc KeycloakContext) UpdateCurrentUsers(users []gocloak.User, userMap Users
 				Attributes: ug.Attributes,
 			}
 			logger.Info("met à jour l'utilisateur et ses attributs", logContext.AddAny("update", update))
-			err := kc.API.UpdateUser(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), update)
+			err := kc.API.UpdateUser(ctx, kc.JWT.AccessToken, kc.getRealmName(), update)
 			if err != nil {
 				logger.Error("erreur pendant la mise à jour de l'utilisateur", logContext, err)
-				return err
+				return !failures.add(OperationError{"mise à jour de l'utilisateur", *user.Username, err})
 			}
 		}
 
-		novel, old := userMap[Username(*user.Username)].getRoles().compare(rolesFromGocloakRoles(roles))
-		if len(old) > 0 {
-			oldRolesLogContext := logContext.Clone().AddArray("oldRoles", old)
-			logger.Info("retire les rôles inutilisés à un utilisateur", oldRolesLogContext)
-			err = kc.API.DeleteClientRolesFromUser(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalID, *user.ID, kc.FindKeycloakRoles(clientName, old))
-			if err != nil {
-				logger.Error("erreur pendant la modification de rôles d'un utilisateur", oldRolesLogContext, err)
+		clientRoles := u.getClientRoles(clientName, kc.Habilitations)
+		if err = kc.syncClientRoles(ctx, user, clients, internalIDs, clientRoles, logContext); err != nil {
+			if failures.add(err) {
+				return false
 			}
 		}
 
-		if len(novel) > 0 {
-			novelRolesLogContext := logContext.Clone().AddArray("novelRoles", novel)
-			logger.Info("ajoute les rôles manquants", novelRolesLogContext)
-			keycloakRoles := kc.FindKeycloakRoles(clientName, novel)
-			err = kc.AddClientRolesToUser(internalID, *user.ID, keycloakRoles)
-			if err != nil {
-				logger.Error("erreur pendant l'jaout des rôles manquants", novelRolesLogContext, err)
+		if err = kc.syncMemberships(ctx, *user.ID, u, logContext); err != nil {
+			logger.Error("erreur pendant la mise à jour des rôles du realm et des groupes", logContext, err)
+			if failures.add(OperationError{"mise à jour des rôles du realm et des groupes", *user.Username, err}) {
+				return false
 			}
 		}
 
 		if len(accountRoles) > 0 {
 			accountRolesLogContext := logContext.Clone().AddArray("accountRoles", accountRoles)
 			logger.Info("disabling account management", accountRolesLogContext)
-			err = kc.API.DeleteClientRolesFromUser(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), accountInternalID, *user.ID, kc.FindKeycloakRoles("account", accountRoles))
+			err = kc.API.DeleteClientRolesFromUser(ctx, kc.JWT.AccessToken, kc.getRealmName(), accountInternalID, *user.ID, kc.FindKeycloakRoles("account", accountRoles))
 			if err != nil {
 				logger.Error("failed to disable management", accountRolesLogContext, err)
+				if failures.add(OperationError{"retrait des rôles account de l'utilisateur", *user.Username, err}) {
+					return false
+				}
 			}
 		}
-	}
+		return true
+	})
+	return failures.err()
+}
 
+// syncClientRoles adds and removes the user roles in each client to match the stock,
+// the first failed operation is returned
+func (kc KeycloakContext) syncClientRoles(ctx context.Context, user gocloak.User, clients []string, internalIDs map[string]string, clientRoles CompositeRoles, logContext *logger.LogContext) error {
+	for _, clientName := range clients {
+		internalID := internalIDs[clientName]
+		clientLogContext := logContext.Clone().AddString("clientId", clientName)
+		roles, err := kc.API.GetClientRolesByUserID(ctx, kc.JWT.AccessToken, kc.getRealmName(), internalID, *user.ID)
+		if err != nil {
+			return OperationError{"lecture des rôles de l'utilisateur", *user.Username, err}
+		}
+		novel, old := clientRoles[clientName].compare(rolesFromGocloakRoles(roles))
+		if len(old) > 0 {
+			oldRolesLogContext := clientLogContext.Clone().AddArray("oldRoles", old)
+			logger.Info("retire les rôles inutilisés à un utilisateur", oldRolesLogContext)
+			err = kc.API.DeleteClientRolesFromUser(ctx, kc.JWT.AccessToken, kc.getRealmName(), internalID, *user.ID, kc.FindKeycloakRoles(clientName, old))
+			if err != nil {
+				logger.Error("erreur pendant la modification de rôles d'un utilisateur", oldRolesLogContext, err)
+				return OperationError{"retrait des rôles de l'utilisateur", *user.Username, err}
+			}
+		}
+		if len(novel) > 0 {
+			novelRolesLogContext := clientLogContext.Clone().AddArray("novelRoles", novel)
+			logger.Info("ajoute les rôles manquants", novelRolesLogContext)
+			err = kc.AddClientRolesToUser(ctx, internalID, *user.ID, kc.FindKeycloakRoles(clientName, novel))
+			if err != nil {
+				logger.Error("erreur pendant l'jaout des rôles manquants", novelRolesLogContext, err)
+				return OperationError{"ajout des rôles à l'utilisateur", *user.Username, err}
+			}
+		}
+	}
 	return nil
 }
 
-// SaveMasterRealm update master Realm
-func (kc *KeycloakContext) SaveMasterRealm(input gocloak.RealmRepresentation) {
-	logContext := logger.ContextForMethod(kc.SaveMasterRealm)
-	id := "master"
-	input.ID = &id
-	input.Realm = &id
-	logger.Info("met à jour le Realm", logContext.AddString("realm", id))
+func (kc KeycloakContext) newFailures() *failures {
+	return &failures{continueOnError: kc.ContinueOnError}
+}
+
+// SaveRealm creates the managed realm if it doesn't exist, then updates it with the configuration
+func (kc *KeycloakContext) SaveRealm(input gocloak.RealmRepresentation) error {
+	logContext := logger.ContextForMethod(kc.SaveRealm)
+	name := kc.getRealmName()
+	input.ID = &name
+	input.Realm = &name
+	logContext.AddString("realm", name)
+	if kc.RealmMissing {
+		enabled := true
+		if input.Enabled == nil {
+			input.Enabled = &enabled
+		}
+		logger.Notice("crée le Realm", logContext)
+		if _, err := kc.API.CreateRealm(context.Background(), kc.JWT.AccessToken, input); err != nil {
+			logger.Error("Erreur pendant la création du Realm", logContext, err)
+			return errors.WithStack(err)
+		}
+		kc.RealmMissing = false
+		if err := kc.refreshRealm(name); err != nil {
+			return err
+		}
+		return errors.WithStack(kc.refresh(logContext))
+	}
+	logger.Info("met à jour le Realm", logContext)
 	if err := kc.API.UpdateRealm(context.Background(), kc.JWT.AccessToken, input); err != nil {
-		logger.Panic("Erreur pendant la mise à jour du Realm ", logContext, err)
+		logger.Error("Erreur pendant la mise à jour du Realm ", logContext, err)
+		return errors.WithStack(err)
 	}
-	kc.refreshRealm(*input.Realm)
+	return kc.refreshRealm(name)
 }
 
-func (kc *KeycloakContext) refreshRealm(realmName string) {
+func (kc *KeycloakContext) refreshRealm(realmName string) error {
 	logContext := logger.ContextForMethod(kc.refreshRealm)
 	logger.Debug("refresh Realm", logContext.AddString("realm", realmName))
 	realm, err := kc.API.GetRealm(context.Background(), kc.JWT.AccessToken, realmName)
 	if err != nil {
-		logger.Panic("Erreur pendant la récupération du Realm", logContext, err)
+		logger.Error("Erreur pendant la récupération du Realm", logContext, err)
+		return errors.WithStack(err)
 	}
 	kc.Realm = realm
+	return nil
 }
 
 // SaveClients save clients then refresh clients list
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// usersServer fakes the Keycloak users API of a realm and counts received calls
+func usersServer(t *testing.T, total int, calls *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls = append(*calls, r.URL.RawQuery)
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		var users []gocloak.User
+		for i := first; i < total && i < first+max; i++ {
+			id, username := strconv.Itoa(i), fmt.Sprintf("user%d@example.com", i)
+			users = append(users, gocloak.User{ID: &id, Username: &username})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(users))
+	}))
+}
+
+func Test_refreshUsers_reads_pages(t *testing.T) {
+	ass := assert.New(t)
+	var calls []string
+	server := usersServer(t, 5, &calls)
+	defer server.Close()
+	realm := "signauxfaibles"
+	kc := KeycloakContext{
+		API:      gocloak.NewClient(server.URL),
+		JWT:      &gocloak.JWT{AccessToken: "token"},
+		Realm:    &gocloak.RealmRepresentation{Realm: &realm},
+		PageSize: 2,
+	}
+
+	require.NoError(t, kc.refreshUsers())
+
+	ass.Len(kc.Users, 5)
+	ass.Equal("user4@example.com", *kc.Users[4].Username)
+	ass.Equal([]string{"first=0&max=2", "first=2&max=2", "first=4&max=2"}, calls)
+}
+
+func Test_cacheUser(t *testing.T) {
+	ass := assert.New(t)
+	id1, id2, disabled := "1", "2", false
+	kc := KeycloakContext{Users: []*gocloak.User{{ID: &id1}}}
+
+	kc.cacheUser(gocloak.User{ID: &id1, Enabled: &disabled})
+	kc.cacheUser(gocloak.User{ID: &id2})
+
+	ass.Len(kc.Users, 2)
+	ass.False(*kc.Users[0].Enabled)
+	kc.uncacheUser(id1)
+	ass.Equal([]*gocloak.User{{ID: &id2}}, kc.Users)
+	ass.Equal(defaultUsersPageSize, KeycloakContext{}.usersPageSize())
+}
@@ -315,11 +315,37 @@ func logUser(client gocloak.Client, user gocloak.User) error {
 	return nil
 }
 
-var ADMIN = User{"0", keycloakAdmin, "", "admin_name", "", "", "", "", nil, "", nil, nil}
+var ADMIN = User{niveau: "0", email: keycloakAdmin, nom: "admin_name"}
 
 var TEST_USERS = Users{
-	"john.doe@zone51.gov.fr":    User{"A", "john.doe@zone51.gov.fr", "John", "Doe", "LISTENS THE WIND", "Recouvrement et accompagnement des entreprises", "PENTAGON", "", nil, "Alsace", nil, nil},
-	"raphael.squelbut@shodo.io": User{"A", "raphael.squelbut@shodo.io", "Raphaël", "SQUELBUT", "sf", "Développeur", "SIGNAUX FAIBLES", "", []string{"wekan"}, "France entière", nil, nil},
-	"quelqun@pasdelurssaf.fr":   User{"B", "quelqun@pasdelurssaf.fr", "quelqun", "pasdelurssaf", "", "Un mec pas de l’URSSAF", "", "", nil, "77", nil, nil},
-	keycloakAdmin:               ADMIN,
+	"john.doe@zone51.gov.fr": User{
+		niveau:            "A",
+		email:             "john.doe@zone51.gov.fr",
+		prenom:            "John",
+		nom:               "Doe",
+		segment:           "LISTENS THE WIND",
+		fonction:          "Recouvrement et accompagnement des entreprises",
+		employeur:         "PENTAGON",
+		accesGeographique: "Alsace",
+	},
+	"raphael.squelbut@shodo.io": User{
+		niveau:            "A",
+		email:             "raphael.squelbut@shodo.io",
+		prenom:            "Raphaël",
+		nom:               "SQUELBUT",
+		segment:           "sf",
+		fonction:          "Développeur",
+		employeur:         "SIGNAUX FAIBLES",
+		scope:             []string{"wekan"},
+		accesGeographique: "France entière",
+	},
+	"quelqun@pasdelurssaf.fr": User{
+		niveau:            "B",
+		email:             "quelqun@pasdelurssaf.fr",
+		prenom:            "quelqun",
+		nom:               "pasdelurssaf",
+		fonction:          "Un mec pas de l’URSSAF",
+		accesGeographique: "77",
+	},
+	keycloakAdmin: ADMIN,
 }
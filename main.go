@@ -3,94 +3,199 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 
 	"github.com/pkg/errors"
 
 	"keycloakUpdater/v2/pkg/config"
 	"keycloakUpdater/v2/pkg/logger"
+	"keycloakUpdater/v2/pkg/structs"
 )
 
+const (
+	exitOK             = 0
+	exitError          = 1
+	exitUsage          = 2
+	exitDiff           = 3
+	exitConfig         = 4
+	exitInvalidStock   = 5
+	exitTooManyChanges = 6
+	exitKeycloak       = 7
+	exitWekan          = 8
+	exitPartial        = 9
+)
+
+const configUsage = "chemin vers le fichier de configuration"
+
 var overridingConfigFilename string
+var loggerConfigured bool
 
 func init() {
-	const (
-		emptyOverridingFilename = ""
-		usage                   = "chemin vers le fichier de configuration"
-	)
-	flag.StringVar(&overridingConfigFilename, "config", emptyOverridingFilename, usage)
-	flag.StringVar(&overridingConfigFilename, "c", emptyOverridingFilename, usage+" (shorthand)")
-
+	addConfigFlags(flag.CommandLine)
+	flag.Usage = printUsage
 }
 
 func main() {
 	flag.Parse()
-	conf, err := config.InitConfig("./config.toml")
-	config.OverrideConfig(conf, overridingConfigFilename)
+	os.Exit(runCommand(flag.Args()))
+}
+
+// runCommand runs the subcommand named by the first argument, `sync` by default
+func runCommand(args []string) int {
+	name := "sync"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, found := findCommand(name)
+	if !found {
+		fmt.Fprintf(os.Stderr, "commande inconnue : %s\n\n", name)
+		printUsage()
+		return exitUsage
+	}
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	addConfigFlags(flags)
+	var options commandOptions
+	if cmd.flags != nil {
+		cmd.flags(flags, &options)
+	}
+	flags.Usage = func() { printCommandUsage(cmd, flags) }
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	targets, err := selectTargets(cmd)
 	if err != nil {
-		panic(err)
+		return reportExit(cmd, flags, newRunSummary(cmd.name), err)
 	}
+	selectedTargets = targets
+	defer func() { currentTarget, selectedTargets = "", nil }()
+	exitCodes := make([]int, len(targets))
+	errs := make([]error, len(targets))
+	for i, target := range targets {
+		currentTarget = target
+		summary := newRunSummary(cmd.name)
+		summary.target = target
+		if target != "" {
+			logger.Notice("traitement de la cible", logger.ContextForMethod(runCommand).AddString("target", target))
+		}
+		errs[i] = cmd.run(summary, options, flags.Args())
+		if errs[i] == nil {
+			errs[i] = summary.err()
+		}
+		exitCodes[i] = reportExit(cmd, flags, summary, errs[i])
+	}
+	if len(targets) == 1 {
+		return exitCodes[0]
+	}
+	return reportTargets(targets, exitCodes, targetsError(targets, errs))
+}
 
-	logger.ConfigureWith(*conf.Logger)
-	logContext := logger.ContextForMethod(main)
+// reportExit prints the error and the summary of a command run, and returns its exit code
+func reportExit(cmd command, flags *flag.FlagSet, summary *runSummary, err error) int {
+	exitCode := exitCodeOf(err)
+	switch exitCode {
+	case exitOK, exitDiff:
+	case exitUsage:
+		fmt.Fprintln(os.Stderr, err)
+		printCommandUsage(cmd, flags)
+	default:
+		reportError(err)
+	}
+	if cmd.name != "version" && cmd.name != "help" && exitCode != exitUsage {
+		summary.report(exitCode)
+	}
+	return exitCode
+}
 
-	// loading desired state for users, composites roles
-	logger.Debug(
-		"lecture du fichier excel stock",
-		logContext.AddString("filename", conf.Stock.UsersAndRolesFilename),
-	)
-	users, compositeRoles, err := loadExcel(conf.Stock.UsersAndRolesFilename)
+func addConfigFlags(flags *flag.FlagSet) {
+	const emptyOverridingFilename = ""
+	flags.StringVar(&overridingConfigFilename, "config", emptyOverridingFilename, configUsage)
+	flags.StringVar(&overridingConfigFilename, "c", emptyOverridingFilename, configUsage+" (shorthand)")
+	flags.StringVar(&targetName, "target", "", targetUsage)
+}
+
+// loadConfig reads the configuration, applies the optional override and target, and configures logs
+func loadConfig() (structs.Config, error) {
+	conf, err := readConfig()
 	if err != nil {
-		logger.Panic("erreur pendant la lecture du fichier Excel", logContext, err)
-	}
-	if conf.Keycloak != nil {
-		keycloakLogContext := logContext.Clone()
-		logger.Notice("mise à jour des habilitations Keycloak", keycloakLogContext.AddString("status", "START"))
-		clientId := conf.Stock.ClientForRoles
-		kc, err := NewKeycloakContext(conf.Keycloak)
-		if err != nil {
-			logger.Panic("erreur pendant l'initialisation du contexte Keycloak'", logContext, err)
+		return structs.Config{}, err
+	}
+	// logs are configured once, even if the configuration is read again for each target
+	if conf.Logger != nil && !loggerConfigured {
+		logger.ConfigureWith(*conf.Logger)
+		loggerConfigured = true
+	}
+	if currentTarget != "" {
+		if conf, err = config.ForTarget(conf, currentTarget); err != nil {
+			return structs.Config{}, ConfigError{err: err}
 		}
+	}
+	// the matrix is checked here, then resolved where it is used: stockRulesFromConfig and KeycloakContext.configure
+	if _, err = resolveHabilitations(conf.Habilitations); err != nil {
+		return structs.Config{}, ConfigError{err: errors.Wrap(err, "matrice d'habilitations invalide")}
+	}
+	return conf, nil
+}
 
-		if err = UpdateKeycloak(
-			&kc,
-			clientId,
-			conf.Realm,
-			conf.Clients,
-			users,
-			compositeRoles,
-			Username(conf.Keycloak.Username),
-			conf.Stock.MaxChangesToAccept,
-		); err != nil {
-			logger.Error("erreur pendant la mise à jour des habilitations Keycloak", logContext, err)
-		}
-		logger.Notice("mise à jour des habilitations Keycloak", keycloakLogContext.AddString("status", "END"))
-	}
-	if conf.Mongo != nil && conf.Wekan != nil {
-		wekanLogContext := logContext.Clone()
-		logger.Notice("mise à jour des habilitations Wekan", wekanLogContext.AddString("status", "START"))
-		err = WekanUpdate(
-			conf.Mongo.Url,
-			conf.Mongo.Database,
-			conf.Wekan.AdminUsername,
-			users,
-			conf.Wekan.SlugDomainRegexp,
-		)
-		if err != nil {
-			logger.Error("erreur pendant la mise à jour des habilitations Wekan", logContext, err)
+// readConfig reads the configuration and applies the optional override
+func readConfig() (conf structs.Config, err error) {
+	// config package panics on unreadable files, the error is recovered for the exit code
+	defer func() {
+		if r := recover(); r != nil {
+			recovered, ok := r.(error)
+			if !ok {
+				recovered = errors.Errorf("%v", r)
+			}
+			conf, err = structs.Config{}, ConfigError{err: recovered}
 		}
-		logger.Notice("mise à jour des habilitations Wekan", wekanLogContext.AddString("status", "END"))
+	}()
+	conf, err = config.InitConfig("./config.toml")
+	if err != nil {
+		return structs.Config{}, ConfigError{err: err}
 	}
+	return config.OverrideConfig(conf, overridingConfigFilename), nil
+}
 
+// loadStock reads the desired state of users and composite roles
+func loadStock(conf structs.Config) (Users, CompositeRoles, error) {
+	logContext := logger.ContextForMethod(loadStock)
+	logger.Debug(
+		"lecture du fichier excel stock",
+		logContext.AddString("filename", stockSource(*conf.Stock)),
+	)
+	options, err := stockOptionsFromConfig(*conf.Stock)
 	if err != nil {
-		logger.Error("le traitement s'est terminé de façon anormale", logContext, err)
-		fmt.Println("======= Détail de l'erreur")
-		printErrChain(err, 0)
-		return
+		return nil, nil, ConfigError{err: err}
+	}
+	users, compositeRoles, err := loadExcel(stockSource(*conf.Stock), options)
+	if err != nil {
+		logger.Error("erreur pendant la lecture du fichier Excel", logContext, err)
+		if !errors.As(err, &InvalidExcelFileError{}) {
+			err = InvalidExcelFileError{msg: "impossible de lire le fichier stock", err: err}
+		}
+		return nil, nil, err
 	}
-	logger.Notice("le traitement s'est terminé correctement ✌️", logContext)
+	return users.withCanonicalZones(compositeRoles), compositeRoles, nil
+}
+
+// reportError logs the error that stopped processing
+func reportError(err error) {
+	logContext := logger.ContextForMethod(reportError)
+	logger.Error("le traitement s'est terminé de façon anormale", logContext, err)
+	fmt.Println("======= Détail de l'erreur")
+	printErrChain(err, 0)
 }
 
 func printErrChain(err error, i int) {
+	if multi, ok := err.(MultiError); ok {
+		fmt.Printf("%d: %s\n", i, multi.label())
+		for _, e := range multi {
+			printErrChain(e, i+1)
+		}
+		return
+	}
 	if err != nil {
 		fmt.Printf("%d: %+v\n", i, err)
 		printErrChain(errors.Unwrap(err), i+1)
@@ -125,7 +125,7 @@ func startKeycloak(pool *dockertest.Pool) *dockertest.Resource {
 	//exponential backoff-retry, because the application in the container might not be ready to accept connections yet
 	if err := pool.Retry(func() error {
 		var err error
-		kc, err = Init("http://localhost:"+keycloakPort+"/auth", "master", keycloakAdmin, keycloakPassword)
+		kc, err = Init("http://localhost:"+keycloakPort+"/auth", "master", "master", keycloakAdmin, keycloakPassword)
 		if err != nil {
 			logger.Trace("keycloak n'est pas prêt", logContext.AddAny("error", err))
 			return err
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/pkg/errors"
+
+	"keycloakUpdater/v2/pkg/logger"
+)
+
+// normalizeGroupPath writes a Keycloak group path with a single leading / and no trailing /
+func normalizeGroupPath(path string) string {
+	names := selectSlice(mapSlice(strings.Split(path, "/"), strings.TrimSpace), func(name string) bool { return name != "" })
+	return "/" + strings.Join(names, "/")
+}
+
+// splitGroupPaths reads the comma separated group paths of a stock cell
+func splitGroupPaths(value string) []string {
+	var paths []string
+	for _, path := range splitExcelValue(value, ",") {
+		paths = append(paths, normalizeGroupPath(path))
+	}
+	return paths
+}
+
+// missingGroupPaths returns the groups to create to get the wanted paths, parents included,
+// each parent comes before its subgroups
+func missingGroupPaths(paths []string, existing map[string]string) []string {
+	var missing Roles
+	for _, path := range paths {
+		names := strings.Split(strings.TrimPrefix(normalizeGroupPath(path), "/"), "/")
+		for i := range names {
+			ancestor := "/" + strings.Join(names[:i+1], "/")
+			if _, found := existing[ancestor]; !found && ancestor != "/" {
+				missing.add(ancestor)
+			}
+		}
+	}
+	slices.Sort(missing)
+	return missing
+}
+
+// refreshGroups fetches the group tree of the realm, indexed by path
+func (kc *KeycloakContext) refreshGroups() error {
+	max := 100000
+	full := true
+	groups, err := kc.API.GetGroups(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), gocloak.GetGroupsParams{
+		Max:  &max,
+		Full: &full,
+	})
+	if err != nil {
+		return err
+	}
+	kc.Groups = make(map[string]string)
+	var walk func(groups []gocloak.Group)
+	walk = func(groups []gocloak.Group) {
+		for _, group := range groups {
+			if group.ID != nil && group.Path != nil {
+				kc.Groups[*group.Path] = *group.ID
+			}
+			if group.SubGroups != nil {
+				walk(*group.SubGroups)
+			}
+		}
+	}
+	for _, group := range groups {
+		walk([]gocloak.Group{*group})
+	}
+	return nil
+}
+
+func (kc *KeycloakContext) refreshRealmRoles() error {
+	var err error
+	kc.Roles, err = kc.API.GetRealmRoles(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), gocloak.GetRoleParams{})
+	return err
+}
+
+// CreateRealmRoles creates managed realm roles missing from Keycloak
+func (kc *KeycloakContext) CreateRealmRoles() (Roles, error) {
+	logContext := logger.ContextForMethod(kc.CreateRealmRoles)
+	missing, _ := kc.ManagedRealmRoles.compare(kc.GetRoles())
+	for _, role := range missing {
+		logger.Info("crée le rôle du realm", logContext.Clone().AddString("role", role))
+		if _, err := kc.API.CreateRealmRole(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), gocloak.Role{Name: &role}); err != nil {
+			return nil, errors.Wrapf(err, "erreur pendant la création du rôle du realm %s", role)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	return missing, kc.refreshRealmRoles()
+}
+
+// CreateGroups creates managed groups missing from Keycloak, with their parent groups
+func (kc *KeycloakContext) CreateGroups() ([]string, error) {
+	logContext := logger.ContextForMethod(kc.CreateGroups)
+	missing := missingGroupPaths(kc.ManagedGroups, kc.Groups)
+	for _, path := range missing {
+		parent, name := path[:strings.LastIndex(path, "/")], path[strings.LastIndex(path, "/")+1:]
+		group := gocloak.Group{Name: &name}
+		logger.Info("crée le groupe", logContext.Clone().AddString("path", path))
+		var id string
+		var err error
+		if parent == "" {
+			id, err = kc.API.CreateGroup(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), group)
+		} else {
+			id, err = kc.API.CreateChildGroup(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), kc.Groups[parent], group)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "erreur pendant la création du groupe %s", path)
+		}
+		kc.Groups[path] = id
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	return missing, kc.refreshGroups()
+}
+
+// managesMemberships tells whether realm roles or groups are assigned by the stock
+func (kc KeycloakContext) managesMemberships() bool {
+	return len(kc.ManagedRealmRoles) > 0 || len(kc.ManagedGroups) > 0
+}
+
+// membershipsOf returns the managed realm roles and groups of the Keycloak user,
+// other realm roles and groups of the user are ignored
+func (kc KeycloakContext) membershipsOf(ctx context.Context, userID string) (Roles, Roles, error) {
+	if !kc.managesMemberships() {
+		return nil, nil, nil
+	}
+	realmRoles, err := kc.API.GetRealmRolesByUserID(ctx, kc.JWT.AccessToken, kc.getRealmName(), userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	max := 100000
+	groups, err := kc.API.GetUserGroups(ctx, kc.JWT.AccessToken, kc.getRealmName(), userID, gocloak.GetGroupsParams{Max: &max})
+	if err != nil {
+		return nil, nil, err
+	}
+	var managedRealmRoles, managedGroups Roles
+	for _, role := range rolesFromGocloakRoles(realmRoles) {
+		if kc.ManagedRealmRoles.contains(role) {
+			managedRealmRoles.add(role)
+		}
+	}
+	for _, group := range groups {
+		if group.Path != nil && contains(kc.ManagedGroups, *group.Path) {
+			managedGroups.add(*group.Path)
+		}
+	}
+	slices.Sort(managedRealmRoles)
+	slices.Sort(managedGroups)
+	return managedRealmRoles, managedGroups, nil
+}
+
+// MembershipChanges describes realm roles and groups to add to or remove from a user
+type MembershipChanges struct {
+	RealmRolesToAdd    Roles
+	RealmRolesToRemove Roles
+	GroupsToAdd        Roles
+	GroupsToRemove     Roles
+}
+
+// membershipChanges compares realm roles and groups of the stock with those of the Keycloak user
+func (kc KeycloakContext) membershipChanges(ctx context.Context, userID string, user User) (MembershipChanges, error) {
+	actualRealmRoles, actualGroups, err := kc.membershipsOf(ctx, userID)
+	if err != nil {
+		return MembershipChanges{}, err
+	}
+	var changes MembershipChanges
+	changes.RealmRolesToAdd, changes.RealmRolesToRemove = Roles(user.realmRoles).compare(actualRealmRoles)
+	changes.GroupsToAdd, changes.GroupsToRemove = Roles(user.groups).compare(actualGroups)
+	return changes, nil
+}
+
+// syncMemberships adds and removes managed realm roles and groups of the Keycloak user according to the stock
+func (kc KeycloakContext) syncMemberships(ctx context.Context, userID string, user User, logContext *logger.LogContext) error {
+	if !kc.managesMemberships() {
+		return nil
+	}
+	changes, err := kc.membershipChanges(ctx, userID, user)
+	if err != nil {
+		return errors.Wrap(err, "erreur pendant la lecture des rôles du realm et des groupes")
+	}
+	if len(changes.RealmRolesToRemove) > 0 {
+		logger.Info("retire les rôles du realm", logContext.Clone().AddArray("realmRoles", changes.RealmRolesToRemove))
+		if err = kc.API.DeleteRealmRoleFromUser(ctx, kc.JWT.AccessToken, kc.getRealmName(), userID, kc.findRealmRoles(changes.RealmRolesToRemove)); err != nil {
+			return errors.Wrap(err, "erreur pendant le retrait des rôles du realm")
+		}
+	}
+	if len(changes.RealmRolesToAdd) > 0 {
+		logger.Info("ajoute les rôles du realm", logContext.Clone().AddArray("realmRoles", changes.RealmRolesToAdd))
+		if err = kc.API.AddRealmRoleToUser(ctx, kc.JWT.AccessToken, kc.getRealmName(), userID, kc.findRealmRoles(changes.RealmRolesToAdd)); err != nil {
+			return errors.Wrap(err, "erreur pendant l'ajout des rôles du realm")
+		}
+	}
+	for _, path := range changes.GroupsToRemove {
+		logger.Info("retire l'utilisateur du groupe", logContext.Clone().AddString("group", path))
+		if err = kc.API.DeleteUserFromGroup(ctx, kc.JWT.AccessToken, kc.getRealmName(), userID, kc.Groups[path]); err != nil {
+			return errors.Wrapf(err, "erreur pendant le retrait du groupe %s", path)
+		}
+	}
+	for _, path := range changes.GroupsToAdd {
+		groupID, found := kc.Groups[path]
+		if !found {
+			return errors.Errorf("le groupe %s n'existe pas dans Keycloak", path)
+		}
+		logger.Info("ajoute l'utilisateur au groupe", logContext.Clone().AddString("group", path))
+		if err = kc.API.AddUserToGroup(ctx, kc.JWT.AccessToken, kc.getRealmName(), userID, groupID); err != nil {
+			return errors.Wrapf(err, "erreur pendant l'ajout au groupe %s", path)
+		}
+	}
+	return nil
+}
+
+// findRealmRoles finds Keycloak realm roles from their names
+func (kc KeycloakContext) findRealmRoles(roles Roles) []gocloak.Role {
+	var gocloakRoles []gocloak.Role
+	for _, role := range kc.Roles {
+		if role != nil && role.Name != nil && roles.contains(*role.Name) {
+			gocloakRoles = append(gocloakRoles, *role)
+		}
+	}
+	return gocloakRoles
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+func Test_normalizeGroupPath(t *testing.T) {
+	ass := assert.New(t)
+	ass.Equal("/dreets/bretagne", normalizeGroupPath("dreets/bretagne"))
+	ass.Equal("/dreets/bretagne", normalizeGroupPath(" /dreets / bretagne/ "))
+	ass.Equal([]string{"/dgfip", "/dreets/bretagne"}, splitGroupPaths("dgfip, /dreets/bretagne"))
+	ass.Nil(splitGroupPaths(""))
+}
+
+func Test_missingGroupPaths_creates_parents_first(t *testing.T) {
+	ass := assert.New(t)
+	existing := map[string]string{"/dreets": "1"}
+
+	missing := missingGroupPaths([]string{"/dgfip/crp/bretagne", "/dreets/bretagne", "/dgfip"}, existing)
+
+	ass.Equal([]string{"/dgfip", "/dgfip/crp", "/dgfip/crp/bretagne", "/dreets/bretagne"}, missing)
+}
+
+func Test_loadExcel_reads_realm_roles_and_groups(t *testing.T) {
+	ass := assert.New(t)
+	header := append(slices.Clone(HEADERS), "ROLES REALM", "GROUPES")
+	filename := writeTestStockWithHeader(t, header, [][]string{
+		{"A", "DGFIP", "", "", "", "Raymond", "DUPONT", "raymond@example.com", "", "", "", "", "offline_access, admin-sf", "dreets/bretagne,/dgfip"},
+	}, nil)
+
+	users, _, err := loadExcel(filename, defaultStockOptions)
+
+	require.NoError(t, err)
+	ass.Equal([]string{"offline_access", "admin-sf"}, users["raymond@example.com"].realmRoles)
+	ass.Equal([]string{"/dreets/bretagne", "/dgfip"}, users["raymond@example.com"].groups)
+	ass.Equal("offline_access,admin-sf", users["raymond@example.com"].excelRow(defaultStockOptions)[len(HEADERS)+2])
+}
+
+func Test_validateExcel_accepts_only_configured_realm_roles_and_groups(t *testing.T) {
+	ass := assert.New(t)
+	header := append(slices.Clone(HEADERS), "ROLES REALM", "GROUPES")
+	filename := writeTestStockWithHeader(t, header, [][]string{
+		{"A", "DGFIP", "", "", "", "Raymond", "DUPONT", "raymond@example.com", "", "", "", "", "admin-sf", "/dreets/bretagne"},
+		{"A", "DGFIP", "", "", "", "Josette", "DUPONT", "josette@example.com", "", "", "", "", "Admin-SF", "/dreets"},
+	}, nil)
+	rules, err := stockRulesFromConfig(structs.Config{Stock: &structs.Stock{
+		RealmRoles: []string{"admin-sf"},
+		Groups:     []string{"dreets/bretagne"},
+	}})
+	require.NoError(t, err)
+
+	stockErrors, err := validateExcel(filename, defaultStockOptions, rules)
+
+	ass.NoError(err)
+	ass.Equal([]StockError{
+		{NOM_PREMIERE_PAGE, 3, "ROLES REALM", `rôle du realm inconnu "Admin-SF", absent de stock.realmRoles`},
+		{NOM_PREMIERE_PAGE, 3, "GROUPES", `groupe inconnu "/dreets", absent de stock.groups`},
+	}, stockErrors)
+}
+
+func Test_configure_reads_managed_realm_roles_and_groups(t *testing.T) {
+	ass := assert.New(t)
+	var kc KeycloakContext
+	err := kc.configure(structs.Config{
+		Stock: &structs.Stock{RealmRoles: []string{"admin-sf", "admin-sf"}, Groups: []string{"dreets/bretagne/"}, DisabledRetentionDays: 30},
+	})
+
+	ass.NoError(err)
+	ass.Equal(defaultHabilitations, kc.Habilitations)
+
+	ass.Equal(Roles{"admin-sf"}, kc.ManagedRealmRoles)
+	ass.Equal([]string{"/dreets/bretagne"}, kc.ManagedGroups)
+	ass.Equal(30, kc.Retention.Days)
+	ass.True(kc.managesMemberships())
+	ass.False(KeycloakContext{}.managesMemberships())
+}
@@ -75,7 +75,6 @@ func getAllConfigFilenames(filename string) []string {
 		)
 	}
 	r = append(r, filename)
-	var files []os.DirEntry
 	config := extractConfig(filename)
 	if config.Stock == nil {
 		return r
@@ -95,13 +94,25 @@ func getAllConfigFilenames(filename string) []string {
 			)
 		}
 	}
-	if files, err = os.ReadDir(folder); err != nil {
+	folderFilenames, err := folderConfigFilenames(folder)
+	if err != nil {
 		logger.Panic(
 			"erreur pendant la lecture des clients Keycloak",
 			logContext.AddAny("folder", folder),
 			err,
 		)
 	}
+	return append(r, folderFilenames...)
+}
+
+// folderConfigFilenames lists the toml files of a configuration folder
+func folderConfigFilenames(folder string) ([]string, error) {
+	logContext := logger.ContextForMethod(folderConfigFilenames)
+	files, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	var r []string
 	for _, f := range files {
 		filename := folder + "/" + f.Name()
 		if !strings.HasSuffix(filename, ".toml") {
@@ -110,21 +121,29 @@ func getAllConfigFilenames(filename string) []string {
 		}
 		r = append(r, filename)
 	}
-	return r
+	return r, nil
 }
 
 func extractConfig(filename string) structs.Config {
-	logContext := logger.ContextForMethod(extractConfig)
-	var conf structs.Config
-	var err error
-	var meta toml.MetaData
-	if meta, err = toml.DecodeFile(filename, &conf); err != nil {
+	conf, err := decodeConfig(filename)
+	if err != nil {
 		logger.Panic(
 			"error pendant le décodage du fichier de configuration Toml",
-			logContext.AddAny("filename", filename),
+			logger.ContextForMethod(extractConfig).AddAny("filename", filename),
 			err,
 		)
 	}
+	return conf
+}
+
+// decodeConfig reads a toml configuration file, an unreadable or malformed file is an error
+func decodeConfig(filename string) (structs.Config, error) {
+	logContext := logger.ContextForMethod(decodeConfig)
+	var conf structs.Config
+	meta, err := toml.DecodeFile(filename, &conf)
+	if err != nil {
+		return structs.Config{}, err
+	}
 	if meta.Undecoded() != nil {
 		for _, key := range meta.Undecoded() {
 			logger.Warn(
@@ -133,5 +152,14 @@ func extractConfig(filename string) structs.Config {
 			)
 		}
 	}
-	return conf
+	return conf, nil
+}
+
+// LoadBoardsConfig reads the file of Wekan boards by segment and region
+func LoadBoardsConfig(filename string) (structs.BoardsConfig, error) {
+	var boardsConfig structs.BoardsConfig
+	if _, err := toml.DecodeFile(filename, &boardsConfig); err != nil {
+		return nil, errors.Wrapf(err, "erreur pendant la lecture du fichier des tableaux %s", filename)
+	}
+	return boardsConfig, nil
 }
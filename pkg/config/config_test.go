@@ -106,3 +106,13 @@ func Test_getAllConfigFilenames(t *testing.T) {
 	actual := getAllConfigFilenames(currentConfigFile)
 	assertions.ElementsMatch(expected, actual)
 }
+
+func Test_LoadBoardsConfig(t *testing.T) {
+	ass := assert.New(t)
+	boardsConfig, err := LoadBoardsConfig("../../test/sample/boards.toml")
+	ass.NoError(err)
+	ass.Contains(boardsConfig["sf"]["France entière"], "tableau-crp-bfc")
+
+	_, err = LoadBoardsConfig("absent.toml")
+	ass.Error(err)
+}
@@ -9,13 +9,21 @@ import (
 )
 
 func merge(first structs.Config, second structs.Config) structs.Config {
-	allClients := concatClients(first.Clients, second.Clients)
-	err := mergo.Merge(&first, second, mergo.WithOverride)
+	merged, err := mergeConfig(first, second)
 	if err != nil {
 		logger.Panic("erreur pendant le merging de la configuration", logger.ContextForMethod(merge), err)
 	}
+	return merged
+}
+
+// mergeConfig overrides the first configuration with the second one, clients are concatenated
+func mergeConfig(first structs.Config, second structs.Config) (structs.Config, error) {
+	allClients := concatClients(first.Clients, second.Clients)
+	if err := mergo.Merge(&first, second, mergo.WithOverride); err != nil {
+		return structs.Config{}, err
+	}
 	first.Clients = allClients
-	return first
+	return first, nil
 }
 
 func concatClients(first []*gocloak.Client, second []*gocloak.Client) []*gocloak.Client {
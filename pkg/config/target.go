@@ -0,0 +1,75 @@
+package config
+
+import (
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"keycloakUpdater/v2/pkg/logger"
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+// TargetNames returns the sorted names of the targets declared in the [targets] section
+func TargetNames(conf structs.Config) []string {
+	var names []string
+	for name := range conf.Targets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ForTarget applies a target to the main configuration, the original configuration isn't modified
+func ForTarget(conf structs.Config, name string) (structs.Config, error) {
+	target, found := conf.Targets[name]
+	if !found {
+		return structs.Config{}, errors.Errorf("cible inconnue : %s", name)
+	}
+	logContext := logger.ContextForMethod(ForTarget).AddString("target", name)
+	logger.Debug("applique la cible", logContext)
+	if conf.Keycloak != nil {
+		keycloak := *conf.Keycloak
+		if target.Realm != "" {
+			keycloak.Realm = target.Realm
+		}
+		conf.Keycloak = &keycloak
+	}
+	if conf.Stock != nil {
+		stock := *conf.Stock
+		if target.ClientForRoles != "" {
+			stock.ClientForRoles = target.ClientForRoles
+		}
+		if target.UsersAndRolesFilename != "" || target.UsersFolder != "" {
+			stock.UsersAndRolesFilename = target.UsersAndRolesFilename
+			stock.UsersFolder = target.UsersFolder
+		}
+		if target.ClientsAndRealmFolder != "" {
+			stock.ClientsAndRealmFolder = target.ClientsAndRealmFolder
+		}
+		conf.Stock = &stock
+	}
+	if conf.Mongo != nil && target.MongoDatabase != "" {
+		mongo := *conf.Mongo
+		mongo.Database = target.MongoDatabase
+		conf.Mongo = &mongo
+	}
+	if target.ClientsAndRealmFolder == "" {
+		return conf, nil
+	}
+	// realm and clients of the target replace those of the main configuration
+	filenames, err := folderConfigFilenames(target.ClientsAndRealmFolder)
+	if err != nil {
+		return structs.Config{}, errors.Wrapf(err, "erreur pendant la lecture du répertoire de la cible %s", name)
+	}
+	conf.Realm, conf.Clients = nil, nil
+	for _, filename := range filenames {
+		current, err := decodeConfig(filename)
+		if err != nil {
+			return structs.Config{}, errors.Wrapf(err, "erreur pendant la lecture du fichier %s de la cible %s", filename, name)
+		}
+		if conf, err = mergeConfig(conf, current); err != nil {
+			return structs.Config{}, errors.Wrapf(err, "erreur pendant la fusion du fichier %s de la cible %s", filename, name)
+		}
+	}
+	return conf, nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+func Test_ForTarget(t *testing.T) {
+	ass := assert.New(t)
+	config, err := InitConfig("test_config.toml")
+	require.NoError(t, err)
+	config.Mongo = &structs.Mongo{Url: "mongodb://localhost", Database: "wekan"}
+	config.Targets = map[string]structs.Target{
+		"staging": {Realm: "sf-staging", MongoDatabase: "wekan-staging", UsersFolder: "users.d"},
+		"tenant":  {ClientForRoles: "tenant", ClientsAndRealmFolder: "../../test/sample/clients.d"},
+	}
+
+	staging, err := ForTarget(config, "staging")
+	require.NoError(t, err)
+	tenant, err := ForTarget(config, "tenant")
+	require.NoError(t, err)
+	_, err = ForTarget(config, "production")
+
+	ass.EqualError(err, "cible inconnue : production")
+	ass.Equal([]string{"staging", "tenant"}, TargetNames(config))
+	ass.Equal("sf-staging", staging.Keycloak.Realm)
+	ass.Equal("wekan-staging", staging.Mongo.Database)
+	ass.Equal("users.d", staging.Stock.UsersFolder)
+	ass.Empty(staging.Stock.UsersAndRolesFilename)
+	ass.Len(staging.Clients, 2)
+	ass.Equal("master", tenant.Keycloak.Realm)
+	ass.Equal("tenant", tenant.Stock.ClientForRoles)
+	ass.Len(tenant.Clients, 1)
+	ass.NotNil(tenant.Realm)
+	// main configuration isn't modified
+	ass.Equal("master", config.Keycloak.Realm)
+	ass.Equal("wekan", config.Mongo.Database)
+	ass.Len(config.Clients, 2)
+}
+
+func Test_ForTarget_returns_error_on_malformed_target_file(t *testing.T) {
+	ass := assert.New(t)
+	config, err := InitConfig("test_config.toml")
+	require.NoError(t, err)
+	folder := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(folder, "realm.toml"), []byte("[realm\nenabled = "), 0o600))
+	config.Targets = map[string]structs.Target{"broken": {ClientsAndRealmFolder: folder}}
+
+	_, err = ForTarget(config, "broken")
+
+	ass.ErrorContains(err, "erreur pendant la lecture du fichier "+filepath.Join(folder, "realm.toml")+" de la cible broken")
+}
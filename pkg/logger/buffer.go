@@ -0,0 +1,69 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+const bufferKey = "buffer"
+
+type bufferContextKey struct{}
+
+// Buffer holds the logs of a concurrent process, Flush writes them as one block in their arrival order
+type Buffer struct {
+	mutex   sync.Mutex
+	records []slog.Record
+}
+
+// WithBuffer holds in buffer the logs written with this context and its clones
+func (d *LogContext) WithBuffer(buffer *Buffer) *LogContext {
+	(*d)[bufferKey] = slog.Any(bufferKey, buffer)
+	return d
+}
+
+// ContextWithBuffer attaches buffer to ctx, so that logs of calls made with this context are held in it
+func ContextWithBuffer(ctx context.Context, buffer *Buffer) context.Context {
+	return context.WithValue(ctx, bufferContextKey{}, buffer)
+}
+
+// WithBufferOf holds the logs written with this context in the buffer attached to ctx, if any
+func (d *LogContext) WithBufferOf(ctx context.Context) *LogContext {
+	if buffer, ok := ctx.Value(bufferContextKey{}).(*Buffer); ok {
+		return d.WithBuffer(buffer)
+	}
+	return d
+}
+
+func (b *Buffer) add(record slog.Record) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.records = append(b.records, record)
+}
+
+// Flush writes held logs, with their original time, and empties the buffer
+func (b *Buffer) Flush() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ctx := context.Background()
+	handler := slog.Default().Handler()
+	for _, record := range b.records {
+		if handler.Enabled(ctx, record.Level) {
+			_ = handler.Handle(ctx, record)
+		}
+	}
+	b.records = nil
+}
+
+// bufferOf returns the buffer attached to the context, nil if none
+func bufferOf(data *LogContext) *Buffer {
+	if data == nil {
+		return nil
+	}
+	attr, found := (*data)[bufferKey]
+	if !found {
+		return nil
+	}
+	buffer, _ := attr.Value.Any().(*Buffer)
+	return buffer
+}
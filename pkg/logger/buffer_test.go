@@ -0,0 +1,45 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Buffer_holds_logs_until_flush(t *testing.T) {
+	ass := assert.New(t)
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+	var output bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&output, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	buffer := &Buffer{}
+	logContext := ContextForMethod(Test_Buffer_holds_logs_until_flush).WithBuffer(buffer)
+
+	Info("premier", logContext.Clone().AddString("user", "raymond"))
+	Debug("ignoré", logContext)
+	Warn("second", logContext)
+	Info("direct", ContextForMethod(Test_Buffer_holds_logs_until_flush))
+
+	ass.Contains(output.String(), "msg=direct")
+	ass.NotContains(output.String(), "premier")
+	buffer.Flush()
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	ass.Len(lines, 3)
+	ass.Contains(lines[1], "msg=premier")
+	ass.Contains(lines[1], "user=raymond")
+	ass.NotContains(lines[1], bufferKey)
+	ass.Contains(lines[2], "msg=second")
+}
+
+func Test_WithBufferOf_uses_the_buffer_of_the_context(t *testing.T) {
+	ass := assert.New(t)
+	buffer := &Buffer{}
+	ctx := ContextWithBuffer(context.Background(), buffer)
+
+	ass.Same(buffer, bufferOf(ContextForMethod(Test_WithBufferOf_uses_the_buffer_of_the_context).WithBufferOf(ctx)))
+	ass.Nil(bufferOf(ContextForMethod(Test_WithBufferOf_uses_the_buffer_of_the_context).WithBufferOf(context.Background())))
+}
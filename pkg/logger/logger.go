@@ -83,13 +83,23 @@ func Panic(msg string, data *LogContext, err error) {
 func logWithContext(level slog.Level, msg string, data *LogContext, err error) {
 	var logCtx []slog.Attr
 	if data != nil {
-		for _, v := range *data {
-			logCtx = append(logCtx, v)
+		for key, v := range *data {
+			if key != bufferKey {
+				logCtx = append(logCtx, v)
+			}
 		}
 	}
 	if err != nil {
 		logCtx = append(logCtx, slog.Any("error", err))
 	}
+	if buffer := bufferOf(data); buffer != nil {
+		if slog.Default().Enabled(context.Background(), level) {
+			record := slog.NewRecord(time.Now(), level, msg, 0)
+			record.AddAttrs(logCtx...)
+			buffer.add(record)
+		}
+		return
+	}
 	slog.LogAttrs(context.Background(), level, msg, logCtx...)
 }
 
@@ -7,19 +7,50 @@ import (
 type Stock struct {
 	ClientsAndRealmFolder string
 	ClientForRoles        string
+	RoleClients           []string // other clients whose roles are assigned with the client:role syntax of the SCOPE column
 	UsersAndRolesFilename string
+	UsersFolder           string // folder of toml or yaml user files, replaces UsersAndRolesFilename
 	BoardsConfigFilename  string
-	MaxChangesToAccept    int // if <=0 then accept all changes
+	MaxChangesToAccept    int               // if <=0 then accept all changes
+	DisabledRetentionDays int               // deletes users disabled for more than N days, 0 keeps them
+	MaxDeletionsToAccept  int               // maximum number of deletions per run, <=0 accepts all of them
+	Scopes                []string          // scopes accepted in the stock besides habilitation roles and wekan
+	Duplicates            string            // handling of duplicate addresses: error (default), first, last or merge
+	CsvSeparator          string            // separator of csv stock files, `,` by default
+	CsvEncoding           string            // encoding of csv stock files (IANA name), utf-8 by default
+	HeaderAliases         map[string]string // other names accepted for headers, e.g. EMAIL = "ADRESSE MAIL"
+	ExtraColumns          map[string]string // extra stock columns and their Keycloak attribute
+	RealmRoles            []string          // realm roles created and assigned by the ROLES REALM column
+	Groups                []string          // paths of groups created and assigned by the GROUPES column, e.g. /dreets/bretagne
 }
 
 type Config struct {
-	Keycloak *Keycloak                    `toml:"keycloak"`
-	Stock    *Stock                       `toml:"stock"`
-	Logger   *LoggerConfig                `toml:"logger"`
-	Realm    *gocloak.RealmRepresentation `toml:"realm"`
-	Clients  []*gocloak.Client            `toml:"clients"`
-	Mongo    *Mongo                       `toml:"mongo"`
-	Wekan    *Wekan                       `toml:"wekan"`
+	Keycloak      *Keycloak                    `toml:"keycloak"`
+	Stock         *Stock                       `toml:"stock"`
+	Logger        *LoggerConfig                `toml:"logger"`
+	Realm         *gocloak.RealmRepresentation `toml:"realm"`
+	Clients       []*gocloak.Client            `toml:"clients"`
+	Mongo         *Mongo                       `toml:"mongo"`
+	Wekan         *Wekan                       `toml:"wekan"`
+	Habilitations map[string]Habilitation      `toml:"habilitations"`
+	Targets       map[string]Target            `toml:"targets"`
+}
+
+// Target describes a target synchronized besides the main configuration,
+// missing keys take the value of the main configuration
+type Target struct {
+	Realm                 string // realm managed by the target
+	ClientForRoles        string
+	ClientsAndRealmFolder string // folder of the [realm] and [clients] files of the target
+	UsersAndRolesFilename string
+	UsersFolder           string
+	MongoDatabase         string // Wekan database of the target
+}
+
+// Habilitation describes a habilitation level: its roles and the levels it inherits roles from
+type Habilitation struct {
+	Roles    []string `toml:"roles"`
+	Inherits []string `toml:"inherits"`
 }
 
 type Mongo struct {
@@ -36,7 +67,20 @@ type Keycloak struct {
 	Address  string
 	Username string
 	Password string
-	Realm    string
+	// ClientID and ClientSecret identify a confidential client whose service account replaces Username and Password
+	ClientID     string
+	ClientSecret string
+	Realm        string // managed realm, created if missing
+	// LoginRealm is the realm of the admin user, Realm by default
+	LoginRealm string
+	PageSize   int // number of users read per call, 500 by default
+	// retries of calls failing transiently: number of attempts (3), waits in milliseconds (500 then at most 10000)
+	// and retried HTTP status codes (429, 502, 503, 504)
+	RetryMaxAttempts int
+	RetryWaitMs      int
+	RetryMaxWaitMs   int
+	RetryStatusCodes []int
+	Concurrency      int // users processed concurrently on creation, disabling and update, 1 by default
 }
 
 type LoggerConfig struct {
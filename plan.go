@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+
+	"keycloakUpdater/v2/pkg/logger"
+)
+
+// KeycloakPlan describes the changes UpdateKeycloak would apply to Keycloak
+type KeycloakPlan struct {
+	ClientID        string                `json:"clientId"`
+	Realm           string                `json:"realm"`
+	CreateRealm     bool                  `json:"createRealm"`
+	UpdateRealm     bool                  `json:"updateRealm"`
+	ClientsToCreate []string              `json:"clientsToCreate"`
+	ClientsToUpdate []string              `json:"clientsToUpdate"`
+	RolesToCreate   Roles                 `json:"rolesToCreate"`
+	RolesToDelete   Roles                 `json:"rolesToDelete"`
+	CompositeRoles  []CompositeRoleChange `json:"compositeRoles"`
+	UsersToCreate   []Username            `json:"usersToCreate"`
+	UsersToDisable  []Username            `json:"usersToDisable"`
+	UsersToEnable   []Username            `json:"usersToEnable"`
+	UsersToUpdate   []Username            `json:"usersToUpdate"`
+	UsersToDelete   []Username            `json:"usersToDelete"`
+	UsersRoles      []UserRolesChange     `json:"usersRoles"`
+	// RealmRolesToCreate, GroupsToCreate and UsersGroups are about realm roles and groups managed by the stock,
+	// users realm roles are in UsersRoles with the realmRolesClient client
+	RealmRolesToCreate Roles              `json:"realmRolesToCreate"`
+	GroupsToCreate     []string           `json:"groupsToCreate"`
+	UsersGroups        []UserGroupsChange `json:"usersGroups"`
+}
+
+// realmRolesClient stands for realm roles in UserRolesChange
+const realmRolesClient = "realm"
+
+// CompositeRoleChange describes roles to add to or remove from a composite role
+type CompositeRoleChange struct {
+	Role   string `json:"role"`
+	Add    Roles  `json:"add"`
+	Remove Roles  `json:"remove"`
+}
+
+// UserRolesChange describes client roles to add to or remove from a user
+type UserRolesChange struct {
+	Username Username `json:"username"`
+	Client   string   `json:"client"`
+	Add      Roles    `json:"add"`
+	Remove   Roles    `json:"remove"`
+}
+
+// UserGroupsChange describes groups to add to or remove from a user
+type UserGroupsChange struct {
+	Username Username `json:"username"`
+	Add      []string `json:"add"`
+	Remove   []string `json:"remove"`
+}
+
+// PlanKeycloak computes the changes to apply to Keycloak without calling any write method
+func PlanKeycloak(
+	kc KeycloakContext,
+	clientId string,
+	realm *gocloak.RealmRepresentation,
+	clients []*gocloak.Client,
+	users Users,
+	compositeRoles CompositeRoles,
+) (KeycloakPlan, error) {
+	logContext := logger.ContextForMethod(PlanKeycloak).AddString("client", clientId)
+	logger.Info("calcule les modifications Keycloak", logContext)
+
+	plan := KeycloakPlan{ClientID: clientId, Realm: kc.getRealmName(), CreateRealm: kc.RealmMissing, UpdateRealm: realm != nil && !kc.RealmMissing}
+	for _, client := range clients {
+		if _, found := kc.GetQuietlyInternalIDFromClientID(*client.ClientID); found {
+			plan.ClientsToUpdate = append(plan.ClientsToUpdate, *client.ClientID)
+		} else {
+			plan.ClientsToCreate = append(plan.ClientsToCreate, *client.ClientID)
+		}
+	}
+
+	// roles of clients other than clientId are written client:role, as in the SCOPE column
+	roleClients := kc.roleClients(clientId)
+	neededRoles := neededClientRoles(clientId, compositeRoles, users, kc.Habilitations)
+	for _, client := range roleClients {
+		newRoles, oldRoles := neededRoles[client].compare(kc.GetClientRoles()[client])
+		plan.RolesToCreate = append(plan.RolesToCreate, qualifiedRoles(client, clientId, newRoles)...)
+		plan.RolesToDelete = append(plan.RolesToDelete, qualifiedRoles(client, clientId, oldRoles)...)
+
+		compositeChanges, err := planCompositeRoles(kc, client, clientCompositeRoles(client, clientId, compositeRoles, neededRoles[client]), newRoles)
+		if err != nil {
+			return KeycloakPlan{}, err
+		}
+		for _, change := range compositeChanges {
+			change.Role = qualifiedRoles(client, clientId, Roles{change.Role})[0]
+			plan.CompositeRoles = append(plan.CompositeRoles, change)
+		}
+	}
+
+	plan.RealmRolesToCreate, _ = kc.ManagedRealmRoles.compare(kc.GetRoles())
+	plan.GroupsToCreate = missingGroupPaths(kc.ManagedGroups, kc.Groups)
+
+	missing, obsolete, enable, current := users.Compare(kc)
+	plan.UsersToCreate = usernamesOf(missing)
+	plan.UsersToDisable = usernamesOf(obsolete)
+	plan.UsersToEnable = usernamesOf(enable)
+	_, toDelete := kc.planRetention(users, time.Now())
+	plan.UsersToDelete = usernamesOf(toDelete)
+
+	for _, user := range missing {
+		for client, roles := range users[Username(*user.Username)].getClientRoles(clientId, kc.Habilitations) {
+			slices.Sort(roles)
+			plan.UsersRoles = append(plan.UsersRoles, UserRolesChange{Username: Username(*user.Username), Client: client, Add: roles})
+		}
+		plan.addMembershipChanges(Username(*user.Username), MembershipChanges{
+			RealmRolesToAdd: sortedRoles(users[Username(*user.Username)].realmRoles),
+			GroupsToAdd:     sortedRoles(users[Username(*user.Username)].groups),
+		})
+	}
+
+	accountInternalID, accountExists := kc.GetQuietlyInternalIDFromClientID("account")
+	for _, kcUser := range current {
+		username := Username(*kcUser.Username)
+		user := users[Username(strings.ToLower(*kcUser.Username))]
+		if user.differsFrom(kcUser) {
+			plan.UsersToUpdate = append(plan.UsersToUpdate, username)
+		}
+		clientRoles := user.getClientRoles(clientId, kc.Habilitations)
+		for _, client := range roleClients {
+			var actualRoles Roles
+			if internalID, clientExists := kc.GetQuietlyInternalIDFromClientID(client); clientExists {
+				roles, err := kc.API.GetClientRolesByUserID(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalID, *kcUser.ID)
+				if err != nil {
+					return KeycloakPlan{}, err
+				}
+				actualRoles = rolesFromGocloakRoles(roles)
+			}
+			novel, old := clientRoles[client].compare(actualRoles)
+			if len(novel) > 0 || len(old) > 0 {
+				plan.UsersRoles = append(plan.UsersRoles, UserRolesChange{Username: username, Client: client, Add: novel, Remove: old})
+			}
+		}
+		changes, err := kc.membershipChanges(context.Background(), *kcUser.ID, user)
+		if err != nil {
+			return KeycloakPlan{}, err
+		}
+		plan.addMembershipChanges(username, changes)
+		if accountExists {
+			accountRoles, err := kc.API.GetClientRolesByUserID(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), accountInternalID, *kcUser.ID)
+			if err != nil {
+				return KeycloakPlan{}, err
+			}
+			if len(accountRoles) > 0 {
+				removed := rolesFromGocloakRoles(accountRoles)
+				slices.Sort(removed)
+				plan.UsersRoles = append(plan.UsersRoles, UserRolesChange{Username: username, Client: "account", Remove: removed})
+			}
+		}
+	}
+	for _, kcUser := range obsolete {
+		changes, err := kc.membershipChanges(context.Background(), *kcUser.ID, User{})
+		if err != nil {
+			return KeycloakPlan{}, err
+		}
+		plan.addMembershipChanges(Username(*kcUser.Username), changes)
+	}
+	slices.SortFunc(plan.UsersRoles, compareUserRolesChange)
+	slices.SortFunc(plan.UsersGroups, func(a, b UserGroupsChange) int { return strings.Compare(string(a.Username), string(b.Username)) })
+	return plan, nil
+}
+
+// addMembershipChanges adds to the plan the realm roles and groups to change for a user
+func (plan *KeycloakPlan) addMembershipChanges(username Username, changes MembershipChanges) {
+	if len(changes.RealmRolesToAdd) > 0 || len(changes.RealmRolesToRemove) > 0 {
+		plan.UsersRoles = append(plan.UsersRoles, UserRolesChange{
+			Username: username,
+			Client:   realmRolesClient,
+			Add:      changes.RealmRolesToAdd,
+			Remove:   changes.RealmRolesToRemove,
+		})
+	}
+	if len(changes.GroupsToAdd) > 0 || len(changes.GroupsToRemove) > 0 {
+		plan.UsersGroups = append(plan.UsersGroups, UserGroupsChange{Username: username, Add: changes.GroupsToAdd, Remove: changes.GroupsToRemove})
+	}
+}
+
+func sortedRoles(roles []string) Roles {
+	sorted := slices.Clone(roles)
+	slices.Sort(sorted)
+	return sorted
+}
+
+func planCompositeRoles(kc KeycloakContext, clientId string, compositeRoles CompositeRoles, newRoles Roles) ([]CompositeRoleChange, error) {
+	var changes []CompositeRoleChange
+	existingRoles := kc.GetClientRoles()[clientId]
+	internalID, clientExists := kc.GetQuietlyInternalIDFromClientID(clientId)
+	for _, r := range kc.ClientRoles[clientId] {
+		composingRoles, err := kc.API.GetCompositeClientRolesByRoleID(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalID, *r.ID)
+		if err != nil {
+			return nil, err
+		}
+		wanted := compositeRoles[*r.Name]
+		add, remove := wanted.compare(rolesFromGocloakRoles(composingRoles))
+		if len(add) > 0 || len(remove) > 0 {
+			changes = append(changes, CompositeRoleChange{Role: *r.Name, Add: add, Remove: remove})
+		}
+	}
+	for role, roles := range compositeRoles {
+		if clientExists && existingRoles.contains(role) {
+			continue
+		}
+		add := slices.Clone(roles)
+		slices.Sort(add)
+		changes = append(changes, CompositeRoleChange{Role: role, Add: add})
+	}
+	slices.SortFunc(changes, func(a, b CompositeRoleChange) int { return strings.Compare(a.Role, b.Role) })
+	return changes, nil
+}
+
+// Changes counts the planned operations
+func (plan KeycloakPlan) Changes() int {
+	count := len(plan.ClientsToCreate) + len(plan.RolesToCreate) + len(plan.RolesToDelete) +
+		len(plan.CompositeRoles) + len(plan.UsersToCreate) + len(plan.UsersToDisable) +
+		len(plan.UsersToEnable) + len(plan.UsersToUpdate) + len(plan.UsersToDelete) + len(plan.UsersRoles) +
+		len(plan.RealmRolesToCreate) + len(plan.GroupsToCreate) + len(plan.UsersGroups)
+	if plan.CreateRealm {
+		count++
+	}
+	return count
+}
+
+// Print writes the plan in a readable format
+func (plan KeycloakPlan) Print(w io.Writer) {
+	fmt.Fprintf(w, "======= Keycloak (client %s) : %d modification(s)\n", plan.ClientID, plan.Changes())
+	if plan.CreateRealm {
+		fmt.Fprintf(w, "realm à créer : %s\n", plan.Realm)
+	}
+	if plan.UpdateRealm {
+		fmt.Fprintln(w, "realm à mettre à jour")
+	}
+	printList(w, "clients à créer", plan.ClientsToCreate)
+	printList(w, "clients à mettre à jour", plan.ClientsToUpdate)
+	printList(w, "rôles à créer", plan.RolesToCreate)
+	printList(w, "rôles à supprimer", plan.RolesToDelete)
+	printList(w, "rôles du realm à créer", plan.RealmRolesToCreate)
+	printList(w, "groupes à créer", plan.GroupsToCreate)
+	if len(plan.CompositeRoles) > 0 {
+		fmt.Fprintf(w, "rôles composites à modifier (%d) :\n", len(plan.CompositeRoles))
+		for _, change := range plan.CompositeRoles {
+			fmt.Fprintf(w, "  %s%s\n", change.Role, formatAddRemove(change.Add, change.Remove))
+		}
+	}
+	printList(w, "utilisateurs à créer", plan.UsersToCreate)
+	printList(w, "utilisateurs à désactiver", plan.UsersToDisable)
+	printList(w, "utilisateurs à activer", plan.UsersToEnable)
+	printList(w, "utilisateurs à mettre à jour", plan.UsersToUpdate)
+	printList(w, "utilisateurs désactivés à supprimer", plan.UsersToDelete)
+	if len(plan.UsersRoles) > 0 {
+		fmt.Fprintf(w, "rôles utilisateurs à modifier (%d) :\n", len(plan.UsersRoles))
+		for _, change := range plan.UsersRoles {
+			fmt.Fprintf(w, "  %s [%s]%s\n", change.Username, change.Client, formatAddRemove(change.Add, change.Remove))
+		}
+	}
+	if len(plan.UsersGroups) > 0 {
+		fmt.Fprintf(w, "groupes utilisateurs à modifier (%d) :\n", len(plan.UsersGroups))
+		for _, change := range plan.UsersGroups {
+			fmt.Fprintf(w, "  %s%s\n", change.Username, formatAddRemove(change.Add, change.Remove))
+		}
+	}
+}
+
+func printList[E ~string](w io.Writer, title string, elements []E) {
+	if len(elements) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s (%d) :\n", title, len(elements))
+	for _, element := range elements {
+		fmt.Fprintf(w, "  %s\n", element)
+	}
+}
+
+func formatAddRemove(add []string, remove []string) string {
+	var r string
+	if len(add) > 0 {
+		r += " +" + strings.Join(add, " +")
+	}
+	if len(remove) > 0 {
+		r += " -" + strings.Join(remove, " -")
+	}
+	return r
+}
+
+func usernamesOf(users []gocloak.User) []Username {
+	usernames := mapSlice(users, func(user gocloak.User) Username { return Username(*user.Username) })
+	slices.Sort(usernames)
+	return usernames
+}
+
+func compareUserRolesChange(a, b UserRolesChange) int {
+	if c := strings.Compare(string(a.Username), string(b.Username)); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Client, b.Client)
+}
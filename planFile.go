@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/signaux-faibles/libwekan"
+
+	"keycloakUpdater/v2/pkg/logger"
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+// PlanFile is the plan written by the `plan` command and read by the `apply` command
+type PlanFile struct {
+	CreatedAt     time.Time     `json:"createdAt"`
+	Target        string        `json:"target,omitempty"`
+	StockFilename string        `json:"stockFilename"`
+	StockChecksum string        `json:"stockChecksum"`
+	Keycloak      *KeycloakPlan `json:"keycloak,omitempty"`
+	KeycloakState string        `json:"keycloakState,omitempty"`
+	Wekan         *WekanPlan    `json:"wekan,omitempty"`
+	WekanState    string        `json:"wekanState,omitempty"`
+}
+
+// buildPlanFile computes the plan and the fingerprint of the state of Keycloak and Wekan at that time,
+// each system is a part of the summary
+func buildPlanFile(summary *runSummary, conf structs.Config, scope syncScope, users Users, compositeRoles CompositeRoles) (PlanFile, error) {
+	checksum, err := fileChecksum(stockSource(*conf.Stock))
+	if err != nil {
+		return PlanFile{}, err
+	}
+	planFile := PlanFile{
+		CreatedAt:     time.Now(),
+		StockFilename: stockSource(*conf.Stock),
+		StockChecksum: checksum,
+	}
+	if scope.keycloak {
+		_ = summary.run("keycloak", func() error {
+			kc, err := NewKeycloakContext(conf.Keycloak)
+			if err != nil {
+				return err
+			}
+			if err = kc.configure(conf); err != nil {
+				return err
+			}
+			plan, err := PlanKeycloak(kc, conf.Stock.ClientForRoles, conf.Realm, conf.Clients, users, compositeRoles)
+			if err != nil {
+				return err
+			}
+			planFile.Keycloak = &plan
+			planFile.KeycloakState = keycloakFingerprint(kc)
+			return nil
+		})
+	}
+	if scope.wekan {
+		_ = summary.run("wekan", func() error {
+			wekan, err := initWekan(conf.Mongo.Url, conf.Mongo.Database, conf.Wekan.AdminUsername, conf.Wekan.SlugDomainRegexp)
+			if err != nil {
+				return err
+			}
+			plan, err := PlanWekan(wekan, users.selectScopeWekan())
+			if err != nil {
+				return err
+			}
+			planFile.Wekan = &plan
+			planFile.WekanState, err = wekanFingerprint(wekan)
+			return err
+		})
+	}
+	return planFile, summary.err()
+}
+
+// applyPlanFile applies the plan after checking that neither the stock nor the state of Keycloak and Wekan changed,
+// each system is a part of the summary and a failing part doesn't prevent the other one
+func applyPlanFile(summary *runSummary, conf structs.Config, planFile PlanFile, users Users, compositeRoles CompositeRoles, continueOnError bool) error {
+	logContext := logger.ContextForMethod(applyPlanFile).AddString("stock", planFile.StockFilename)
+	if planFile.StockFilename != stockSource(*conf.Stock) {
+		return PlanDriftError{target: "stock", msg: fmt.Sprintf("le plan a été calculé avec le fichier %s", planFile.StockFilename)}
+	}
+	checksum, err := fileChecksum(stockSource(*conf.Stock))
+	if err != nil {
+		return err
+	}
+	if checksum != planFile.StockChecksum {
+		return PlanDriftError{target: "stock", msg: "le fichier a été modifié depuis le calcul du plan"}
+	}
+	if planFile.Keycloak != nil && conf.Keycloak == nil || planFile.Wekan != nil && (conf.Mongo == nil || conf.Wekan == nil) {
+		return PlanDriftError{target: "config", msg: "les sections [keycloak] et [wekan] ne correspondent pas au plan"}
+	}
+
+	// every check is done before any write
+	var kc KeycloakContext
+	if planFile.Keycloak != nil {
+		if kc, err = checkKeycloakPlan(conf, planFile, users, compositeRoles); err != nil {
+			return SyncError{part: "keycloak", err: err}
+		}
+	}
+	var wekan libwekan.Wekan
+	if planFile.Wekan != nil {
+		if wekan, err = checkWekanPlan(conf, planFile, users); err != nil {
+			return SyncError{part: "wekan", err: err}
+		}
+	}
+
+	logger.Notice("le plan est à jour, applique les modifications", logContext)
+	if planFile.Keycloak != nil {
+		_ = summary.run("keycloak", func() error {
+			kc.ContinueOnError = continueOnError
+			return UpdateKeycloak(
+				&kc,
+				conf.Stock.ClientForRoles,
+				conf.Realm,
+				conf.Clients,
+				users,
+				compositeRoles,
+				adminUsername(conf.Keycloak),
+				conf.Stock.MaxChangesToAccept,
+			)
+		})
+	}
+	if planFile.Wekan != nil {
+		_ = summary.run("wekan", func() error {
+			return pipeline.Run(wekan, users.selectScopeWekan())
+		})
+	}
+	return summary.err()
+}
+
+// checkKeycloakPlan connects to Keycloak and checks that its state and the computed changes match the plan
+func checkKeycloakPlan(conf structs.Config, planFile PlanFile, users Users, compositeRoles CompositeRoles) (KeycloakContext, error) {
+	kc, err := NewKeycloakContext(conf.Keycloak)
+	if err != nil {
+		return KeycloakContext{}, err
+	}
+	if err = kc.configure(conf); err != nil {
+		return KeycloakContext{}, err
+	}
+	if keycloakFingerprint(kc) != planFile.KeycloakState {
+		return KeycloakContext{}, PlanDriftError{target: "keycloak", msg: "les utilisateurs ou les rôles ont été modifiés depuis le calcul du plan"}
+	}
+	plan, err := PlanKeycloak(kc, conf.Stock.ClientForRoles, conf.Realm, conf.Clients, users, compositeRoles)
+	if err != nil {
+		return KeycloakContext{}, err
+	}
+	if !samePlan(plan, *planFile.Keycloak) {
+		return KeycloakContext{}, PlanDriftError{target: "keycloak", msg: "les modifications calculées diffèrent du plan"}
+	}
+	return kc, nil
+}
+
+// checkWekanPlan connects to Wekan and checks that its state and the computed changes match the plan
+func checkWekanPlan(conf structs.Config, planFile PlanFile, users Users) (libwekan.Wekan, error) {
+	wekan, err := initWekan(conf.Mongo.Url, conf.Mongo.Database, conf.Wekan.AdminUsername, conf.Wekan.SlugDomainRegexp)
+	if err != nil {
+		return libwekan.Wekan{}, err
+	}
+	state, err := wekanFingerprint(wekan)
+	if err != nil {
+		return libwekan.Wekan{}, err
+	}
+	if state != planFile.WekanState {
+		return libwekan.Wekan{}, PlanDriftError{target: "wekan", msg: "les utilisateurs, les membres des tableaux ou les règles ont été modifiés depuis le calcul du plan"}
+	}
+	plan, err := PlanWekan(wekan, users.selectScopeWekan())
+	if err != nil {
+		return libwekan.Wekan{}, err
+	}
+	if !samePlan(plan, *planFile.Wekan) {
+		return libwekan.Wekan{}, PlanDriftError{target: "wekan", msg: "les modifications calculées diffèrent du plan"}
+	}
+	return wekan, nil
+}
+
+func writePlanFile(planFile PlanFile, filename string) error {
+	data, err := json.MarshalIndent(planFile, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(filename, data, 0644))
+}
+
+func readPlanFile(filename string) (PlanFile, error) {
+	var planFile PlanFile
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return PlanFile{}, errors.WithStack(err)
+	}
+	if err = json.Unmarshal(data, &planFile); err != nil {
+		return PlanFile{}, errors.Wrap(err, "le fichier de plan est invalide")
+	}
+	return planFile, nil
+}
+
+// keycloakFingerprint sums up Keycloak users and client roles
+func keycloakFingerprint(kc KeycloakContext) string {
+	var lines []string
+	for _, user := range kc.Users {
+		var attributes []string
+		if user.Attributes != nil {
+			for key, values := range *user.Attributes {
+				sorted := slices.Clone(values)
+				slices.Sort(sorted)
+				attributes = append(attributes, key+"="+strings.Join(sorted, ","))
+			}
+		}
+		slices.Sort(attributes)
+		lines = append(lines, fmt.Sprintf(
+			"user\t%s\t%t\t%s\t%s\t%s",
+			stringOrEmpty(user.Username),
+			user.Enabled != nil && *user.Enabled,
+			stringOrEmpty(user.FirstName),
+			stringOrEmpty(user.LastName),
+			strings.Join(attributes, ";"),
+		))
+	}
+	for client, roles := range kc.GetClientRoles() {
+		sorted := slices.Clone(roles)
+		slices.Sort(sorted)
+		lines = append(lines, fmt.Sprintf("roles\t%s\t%s", client, strings.Join(sorted, ",")))
+	}
+	return checksumOf(lines)
+}
+
+// wekanFingerprint sums up users, board members and rules of the Wekan domain
+func wekanFingerprint(wekan libwekan.Wekan) (string, error) {
+	var lines []string
+	users, err := wekan.GetUsers(context.Background())
+	if err != nil {
+		return "", err
+	}
+	for _, user := range users {
+		lines = append(lines, fmt.Sprintf("user\t%s\t%s\t%t", user.ID, user.Username, user.LoginDisabled))
+	}
+	boards, err := wekan.SelectDomainBoards(context.Background())
+	if err != nil {
+		return "", err
+	}
+	for _, board := range boards {
+		for _, member := range board.Members {
+			lines = append(lines, fmt.Sprintf("member\t%s\t%s\t%t\t%t", board.Slug, member.UserID, member.IsActive, member.IsAdmin))
+		}
+		rules, err := wekan.SelectRulesFromBoardID(context.Background(), board.ID)
+		if err != nil {
+			return "", err
+		}
+		for _, rule := range taskforceRulesOf(board, rules) {
+			lines = append(lines, "rule\t"+rule.String())
+		}
+	}
+	return checksumOf(lines), nil
+}
+
+func samePlan(a any, b any) bool {
+	jsonA, errA := json.Marshal(a)
+	jsonB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(jsonA, jsonB)
+}
+
+func checksumOf(lines []string) string {
+	slices.Sort(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// fileChecksum computes the checksum of the stock file, or of the user files if it is a folder
+func fileChecksum(filename string) (string, error) {
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		filenames, err := usersFolderFiles(filename)
+		if err != nil {
+			return "", err
+		}
+		var lines []string
+		for _, f := range filenames {
+			sum, err := fileChecksum(f)
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, f+"\t"+sum)
+		}
+		return checksumOf(lines), nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+func TestPlanFile_write_then_read(t *testing.T) {
+	ass := assert.New(t)
+	filename := filepath.Join(t.TempDir(), "plan.json")
+	expected := PlanFile{
+		StockFilename: "userBase.xlsx",
+		StockChecksum: "abcd",
+		Keycloak: &KeycloakPlan{
+			ClientID:      "signauxfaibles",
+			UsersToCreate: []Username{"nouveau@example.com"},
+		},
+		KeycloakState: "efgh",
+	}
+
+	require.NoError(t, writePlanFile(expected, filename))
+	actual, err := readPlanFile(filename)
+
+	ass.NoError(err)
+	ass.True(samePlan(*expected.Keycloak, *actual.Keycloak))
+	ass.Equal(expected.KeycloakState, actual.KeycloakState)
+	ass.Nil(actual.Wekan)
+}
+
+func TestPlanFile_samePlan_detects_differences(t *testing.T) {
+	ass := assert.New(t)
+	plan := KeycloakPlan{ClientID: "signauxfaibles", RolesToCreate: Roles{"score"}}
+	other := KeycloakPlan{ClientID: "signauxfaibles", RolesToCreate: Roles{"score", "pge"}}
+	ass.True(samePlan(plan, plan))
+	ass.False(samePlan(plan, other))
+}
+
+func TestPlanFile_keycloakFingerprint_changes_when_user_is_disabled(t *testing.T) {
+	ass := assert.New(t)
+	username := "user@example.com"
+	enabled := true
+	kc := KeycloakContext{Users: []*gocloak.User{{Username: &username, Enabled: &enabled}}}
+	before := keycloakFingerprint(kc)
+	ass.Equal(before, keycloakFingerprint(kc))
+
+	disabled := false
+	kc.Users[0].Enabled = &disabled
+	ass.NotEqual(before, keycloakFingerprint(kc))
+}
+
+func TestPlanFile_fileChecksum(t *testing.T) {
+	ass := assert.New(t)
+	checksum, err := fileChecksum("./userBase.xlsx")
+	ass.NoError(err)
+	ass.Len(checksum, 64)
+
+	_, err = fileChecksum("./inexistant.xlsx")
+	ass.Error(err)
+}
+
+func TestPlanFile_applyPlanFile_exits_with_keycloak_code_when_keycloak_fails(t *testing.T) {
+	ass := assert.New(t)
+	checksum, err := fileChecksum("./userBase.xlsx")
+	require.NoError(t, err)
+	conf := structs.Config{
+		Stock: &structs.Stock{UsersAndRolesFilename: "./userBase.xlsx", ClientForRoles: "signauxfaibles"},
+		// no Keycloak listens on this port, a single attempt
+		Keycloak: &structs.Keycloak{Address: "http://127.0.0.1:1", Username: "admin", Password: "pwd", Realm: "master", RetryMaxAttempts: 1},
+	}
+	planFile := PlanFile{
+		StockFilename: "./userBase.xlsx",
+		StockChecksum: checksum,
+		Keycloak:      &KeycloakPlan{ClientID: "signauxfaibles"},
+	}
+	summary := newRunSummary("apply")
+
+	err = applyPlanFile(summary, conf, planFile, Users{}, CompositeRoles{}, false)
+
+	ass.Error(err)
+	ass.Equal(exitKeycloak, exitCodeOf(err))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/signaux-faibles/libwekan"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlan_compareBoardMembers(t *testing.T) {
+	ass := assert.New(t)
+	active := []libwekan.Username{"admin", "parti", "reste"}
+	wanted := []libwekan.Username{"admin", "reste", "nouveau"}
+
+	change := compareBoardMembers("tableau", active, wanted)
+
+	ass.Equal(libwekan.BoardSlug("tableau"), change.Board)
+	ass.Equal([]libwekan.Username{"nouveau"}, change.Add)
+	ass.Equal([]libwekan.Username{"parti"}, change.Remove)
+}
+
+func TestPlan_compareTaskforceRules(t *testing.T) {
+	ass := assert.New(t)
+	board := libwekan.Board{
+		Slug:   "tableau",
+		Labels: []libwekan.BoardLabel{{ID: "1", Name: "taskforce"}, {ID: "2", Name: "autre"}},
+	}
+	boards := map[libwekan.BoardSlug]libwekan.Board{board.Slug: board}
+	users := Users{
+		"user1": User{email: "user1", boards: []string{"tableau"}, taskforces: []string{"taskforce"}},
+		"user2": User{email: "user2", boards: []string{"tableau"}},
+	}
+	existing := []TaskforceRule{
+		{"tableau", "taskforce", "user1", "addMember"},
+		{"tableau", "autre", "user2", "addMember"},
+	}
+
+	toAdd, toRemove := users.compareTaskforceRules(boards, existing)
+
+	ass.Equal([]TaskforceRule{{"tableau", "taskforce", "user1", "removeMember"}}, toAdd)
+	ass.Equal([]TaskforceRule{{"tableau", "autre", "user2", "addMember"}}, toRemove)
+}
+
+func TestPlan_print_keycloak_plan(t *testing.T) {
+	ass := assert.New(t)
+	plan := KeycloakPlan{
+		ClientID:      "signauxfaibles",
+		RolesToCreate: Roles{"score"},
+		UsersToCreate: []Username{"nouveau@example.com"},
+		UsersRoles: []UserRolesChange{
+			{Username: "nouveau@example.com", Client: "signauxfaibles", Add: Roles{"score"}},
+		},
+	}
+	var output bytes.Buffer
+
+	plan.Print(&output)
+
+	ass.Equal(3, plan.Changes())
+	ass.Contains(output.String(), "rôles à créer (1) :\n  score\n")
+	ass.Contains(output.String(), "utilisateurs à créer (1) :\n  nouveau@example.com\n")
+	ass.Contains(output.String(), "nouveau@example.com [signauxfaibles] +score\n")
+}
+
+func TestPlan_print_missing_realm(t *testing.T) {
+	ass := assert.New(t)
+	plan := KeycloakPlan{ClientID: "signauxfaibles", Realm: "signauxfaibles", CreateRealm: true}
+	var output bytes.Buffer
+
+	plan.Print(&output)
+
+	ass.Equal(1, plan.Changes())
+	ass.Contains(output.String(), "realm à créer : signauxfaibles\n")
+}
+
+func TestPlan_empty_wekan_plan_has_no_change(t *testing.T) {
+	ass := assert.New(t)
+	plan := WekanPlan{BoardsMembers: []BoardMembersChange{{Board: "tableau"}}}
+	ass.Zero(plan.Changes())
+}
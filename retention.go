@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+
+	"keycloakUpdater/v2/pkg/logger"
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+// disabledAtAttribute is the Keycloak attribute where keycloakUpdater writes when a user was disabled
+const disabledAtAttribute = "keycloakupdater_disabled_at"
+
+// RetentionPolicy tells after how many days a disabled user is deleted from Keycloak
+type RetentionPolicy struct {
+	// Days is 0 when disabled users are kept
+	Days int
+	// MaxDeletions limits the number of deletions of a run, 0 accepts every deletion
+	MaxDeletions int
+}
+
+func retentionPolicyOf(stock *structs.Stock) RetentionPolicy {
+	if stock == nil {
+		return RetentionPolicy{}
+	}
+	return RetentionPolicy{Days: stock.DisabledRetentionDays, MaxDeletions: stock.MaxDeletionsToAccept}
+}
+
+// planRetention returns disabled users out of the stock without a disabling date, to be dated,
+// and those disabled for longer than the retention period, to be deleted
+func (kc KeycloakContext) planRetention(users Users, now time.Time) ([]gocloak.User, []gocloak.User) {
+	if kc.Retention.Days <= 0 {
+		return nil, nil
+	}
+	active := users.selectActive(now)
+	limit := now.AddDate(0, 0, -kc.Retention.Days)
+	var toStamp, toDelete []gocloak.User
+	for _, kcUser := range kc.Users {
+		if kcUser.Username == nil || kcUser.Enabled == nil || *kcUser.Enabled {
+			continue
+		}
+		if _, found := active[Username(strings.ToLower(*kcUser.Username))]; found {
+			continue
+		}
+		disabledAt, err := time.Parse(time.RFC3339, firstAttribute(*kcUser, disabledAtAttribute))
+		switch {
+		case err != nil:
+			toStamp = append(toStamp, *kcUser)
+		case disabledAt.Before(limit):
+			toDelete = append(toDelete, *kcUser)
+		}
+	}
+	return toStamp, toDelete
+}
+
+// checkDeletions refuses deletions beyond the configured maximum
+func (kc KeycloakContext) checkDeletions(toDelete []gocloak.User) error {
+	if kc.Retention.MaxDeletions > 0 && len(toDelete) > kc.Retention.MaxDeletions {
+		logger.Warn("trop d'utilisateurs à supprimer", logger.ContextForMethod(kc.checkDeletions).
+			AddInt("max", kc.Retention.MaxDeletions).
+			AddInt("current", len(toDelete)))
+		return TooManyDeletionsError{deletions: len(toDelete), max: kc.Retention.MaxDeletions}
+	}
+	return nil
+}
+
+// ApplyRetention dates users disabled before retention was enabled and deletes expired users
+func (kc *KeycloakContext) ApplyRetention(toStamp []gocloak.User, toDelete []gocloak.User, now time.Time) error {
+	logContext := logger.ContextForMethod(kc.ApplyRetention)
+	failures := kc.newFailures()
+	for _, user := range toStamp {
+		userLogContext := logContext.Clone().AddUser(user)
+		logger.Info("date la désactivation de l'utilisateur", userLogContext)
+		user.Attributes = withDisabledAt(user.Attributes, now)
+		if err := kc.API.UpdateUser(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), user); err != nil {
+			logger.Error("erreur pendant la datation de la désactivation", userLogContext, err)
+			if failures.add(OperationError{"datation de la désactivation", *user.Username, err}) {
+				break
+			}
+			continue
+		}
+		kc.cacheUser(user)
+	}
+	for _, user := range toDelete {
+		if len(failures.errs) > 0 && !kc.ContinueOnError {
+			break
+		}
+		userLogContext := logContext.Clone().AddUser(user).AddString("disabledAt", firstAttribute(user, disabledAtAttribute))
+		logger.Notice("supprime l'utilisateur désactivé", userLogContext)
+		if err := kc.API.DeleteUser(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), *user.ID); err != nil {
+			logger.Error("erreur pendant la suppression de l'utilisateur", userLogContext, err)
+			if failures.add(OperationError{"suppression de l'utilisateur", *user.Username, err}) {
+				break
+			}
+			continue
+		}
+		kc.uncacheUser(*user.ID)
+	}
+	return failures.err()
+}
+
+// withDisabledAt returns a copy of attributes with the disabling date
+func withDisabledAt(attributes *map[string][]string, now time.Time) *map[string][]string {
+	stamped := make(map[string][]string)
+	if attributes != nil {
+		for key, values := range *attributes {
+			stamped[key] = values
+		}
+	}
+	stamped[disabledAtAttribute] = []string{now.Format(time.RFC3339)}
+	return &stamped
+}
+
+// withoutDisabledAt returns a copy of attributes without the disabling date
+func withoutDisabledAt(attributes *map[string][]string) *map[string][]string {
+	if attributes == nil {
+		return nil
+	}
+	cleaned := make(map[string][]string)
+	for key, values := range *attributes {
+		if key != disabledAtAttribute {
+			cleaned[key] = values
+		}
+	}
+	return &cleaned
+}
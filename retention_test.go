@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_planRetention(t *testing.T) {
+	ass := assert.New(t)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	enabled, disabled := true, false
+	old, recent, unstamped, inStock, active := "old@example.com", "recent@example.com", "unstamped@example.com", "instock@example.com", "active@example.com"
+	oldAttributes := map[string][]string{disabledAtAttribute: {now.AddDate(0, 0, -31).Format(time.RFC3339)}}
+	recentAttributes := map[string][]string{disabledAtAttribute: {now.AddDate(0, 0, -29).Format(time.RFC3339)}}
+	kc := KeycloakContext{
+		Users: []*gocloak.User{
+			{Username: &old, Enabled: &disabled, Attributes: &oldAttributes},
+			{Username: &recent, Enabled: &disabled, Attributes: &recentAttributes},
+			{Username: &unstamped, Enabled: &disabled},
+			{Username: &inStock, Enabled: &disabled, Attributes: &oldAttributes},
+			{Username: &active, Enabled: &enabled, Attributes: &oldAttributes},
+		},
+		Retention: RetentionPolicy{Days: 30},
+	}
+	users := Users{Username(inStock): {email: Username(inStock)}}
+
+	toStamp, toDelete := kc.planRetention(users, now)
+
+	ass.Equal([]gocloak.User{*kc.Users[2]}, toStamp)
+	ass.Equal([]gocloak.User{*kc.Users[0]}, toDelete)
+
+	kc.Retention = RetentionPolicy{}
+	toStamp, toDelete = kc.planRetention(users, now)
+	ass.Empty(toStamp)
+	ass.Empty(toDelete)
+}
+
+func Test_checkDeletions(t *testing.T) {
+	ass := assert.New(t)
+	toDelete := make([]gocloak.User, 3)
+	kc := KeycloakContext{Retention: RetentionPolicy{Days: 30, MaxDeletions: 2}}
+
+	err := kc.checkDeletions(toDelete)
+
+	ass.Equal(TooManyDeletionsError{deletions: 3, max: 2}, err)
+	ass.Equal(exitTooManyChanges, exitCodeOf(SyncError{part: "keycloak", err: err}))
+	ass.NoError(kc.checkDeletions(toDelete[:2]))
+	kc.Retention.MaxDeletions = 0
+	ass.NoError(kc.checkDeletions(toDelete))
+}
+
+func Test_withDisabledAt_copies_attributes(t *testing.T) {
+	ass := assert.New(t)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	attributes := map[string][]string{"fonction": {"inspecteur"}}
+
+	stamped := withDisabledAt(&attributes, now)
+
+	ass.Equal(map[string][]string{"fonction": {"inspecteur"}, disabledAtAttribute: {"2024-06-01T12:00:00Z"}}, *stamped)
+	ass.Equal(map[string][]string{"fonction": {"inspecteur"}}, attributes)
+	ass.Equal(attributes, *withoutDisabledAt(stamped))
+	ass.Contains(*stamped, disabledAtAttribute)
+	ass.Nil(withoutDisabledAt(nil))
+}
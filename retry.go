@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"keycloakUpdater/v2/pkg/logger"
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+// RetryPolicy describes retries of Keycloak calls after a transient error:
+// network error or HTTP status code of StatusCodes
+type RetryPolicy struct {
+	MaxAttempts int           // attempts per call, first one included
+	Wait        time.Duration // wait before the second attempt, doubled for each following attempt
+	MaxWait     time.Duration // maximum wait between two attempts
+	StatusCodes []int
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Wait:        500 * time.Millisecond,
+	MaxWait:     10 * time.Second,
+	StatusCodes: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+}
+
+// retryPolicyFromConfig reads the policy from the [keycloak] section, missing keys take the default value
+func retryPolicyFromConfig(access structs.Keycloak) RetryPolicy {
+	policy := defaultRetryPolicy
+	if access.RetryMaxAttempts > 0 {
+		policy.MaxAttempts = access.RetryMaxAttempts
+	}
+	if access.RetryWaitMs > 0 {
+		policy.Wait = time.Duration(access.RetryWaitMs) * time.Millisecond
+	}
+	if access.RetryMaxWaitMs > 0 {
+		policy.MaxWait = time.Duration(access.RetryMaxWaitMs) * time.Millisecond
+	}
+	if len(access.RetryStatusCodes) > 0 {
+		policy.StatusCodes = access.RetryStatusCodes
+	}
+	return policy
+}
+
+// backoff computes the wait after attempt: exponential, capped at MaxWait,
+// then drawn between half and all of this value to spread attempts
+func (policy RetryPolicy) backoff(attempt int, random func() float64) time.Duration {
+	wait := policy.Wait
+	for i := 1; i < attempt && wait < policy.MaxWait; i++ {
+		wait *= 2
+	}
+	if wait > policy.MaxWait {
+		wait = policy.MaxWait
+	}
+	return wait/2 + time.Duration(random()*float64(wait/2))
+}
+
+// retryable tells whether the call failed transiently
+func (policy RetryPolicy) retryable(request *http.Request, response *http.Response, err error) bool {
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		// Keycloak may have processed a POST before the connection failed, it's only sent again if it wasn't sent
+		return request.Method != http.MethodPost || notSent(err)
+	}
+	return slices.Contains(policy.StatusCodes, response.StatusCode)
+}
+
+// notSent tells whether the call failed before the connection to Keycloak was established
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryTransport retries Keycloak calls failing transiently according to policy,
+// and once, with a new token, calls refused with a 401 status code
+type retryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+	token  *adminToken
+	sleep  func(ctx context.Context, wait time.Duration) error
+	random func() float64
+}
+
+func newRetryTransport(base http.RoundTripper, policy RetryPolicy, token *adminToken) *retryTransport {
+	return &retryTransport{base: base, policy: policy, token: token, sleep: sleepContext, random: rand.Float64}
+}
+
+func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	logContext := logger.ContextForMethod(t.RoundTrip).
+		AddString("method", request.Method).
+		AddString("url", request.URL.Redacted()).
+		WithBufferOf(request.Context())
+	payload, err := readBody(request)
+	if err != nil {
+		return nil, err
+	}
+	tokenReplayed := false
+	current := cloneRequest(request, payload)
+	for attempt := 1; ; attempt++ {
+		response, err := t.base.RoundTrip(current)
+		bearer, hasBearer := strings.CutPrefix(current.Header.Get("Authorization"), "Bearer ")
+		if err == nil && response.StatusCode == http.StatusUnauthorized && t.token != nil && hasBearer && !tokenReplayed {
+			// the refused token is renewed, this retry isn't counted
+			logger.Info("token refusé, la requête est rejouée avec un nouveau token", logContext)
+			tokenReplayed = true
+			attempt--
+			t.token.invalidate(bearer)
+			accessToken, tokenErr := t.token.accessToken(request.Context())
+			if tokenErr != nil {
+				return response, nil
+			}
+			next := cloneRequest(request, payload)
+			discard(response)
+			next.Header.Set("Authorization", "Bearer "+accessToken)
+			current = next
+			continue
+		}
+		if attempt >= t.policy.MaxAttempts || !t.policy.retryable(current, response, err) {
+			return response, err
+		}
+		next := cloneRequest(current, payload)
+		wait := t.policy.backoff(attempt, t.random)
+		retryLogContext := logContext.Clone().
+			AddInt("attempt", attempt).
+			AddInt("maxAttempts", t.policy.MaxAttempts).
+			AddString("wait", wait.Round(time.Millisecond).String())
+		if err != nil {
+			retryLogContext.AddString("error", err.Error())
+		} else {
+			retryLogContext.AddInt("status", response.StatusCode)
+			discard(response)
+		}
+		logger.Warn("échec transitoire de l'appel à Keycloak, nouvel essai", retryLogContext)
+		if sleepErr := t.sleep(request.Context(), wait); sleepErr != nil {
+			return nil, sleepErr
+		}
+		current = next
+	}
+}
+
+// readBody copies the body of the request before the first attempt,
+// the caller may reuse its buffer once the body is closed, as resty does
+func readBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, nil
+	}
+	defer request.Body.Close()
+	payload, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "erreur pendant la lecture du contenu de la requête")
+	}
+	return payload, nil
+}
+
+// cloneRequest prepares an attempt of the request, its body reads the copy of the original body
+func cloneRequest(request *http.Request, payload []byte) *http.Request {
+	next := request.Clone(request.Context())
+	if len(payload) == 0 {
+		next.Body, next.GetBody = http.NoBody, nil
+		return next
+	}
+	next.Body = io.NopCloser(bytes.NewReader(payload))
+	next.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	}
+	next.ContentLength = int64(len(payload))
+	return next
+}
+
+// discard releases the connection of a dropped response
+func discard(response *http.Response) {
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+}
+
+func sleepContext(ctx context.Context, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
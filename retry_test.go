@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+func Test_retryPolicyFromConfig(t *testing.T) {
+	ass := assert.New(t)
+	ass.Equal(defaultRetryPolicy, retryPolicyFromConfig(structs.Keycloak{}))
+
+	policy := retryPolicyFromConfig(structs.Keycloak{RetryMaxAttempts: 5, RetryWaitMs: 100, RetryStatusCodes: []int{502}})
+
+	ass.Equal(RetryPolicy{MaxAttempts: 5, Wait: 100 * time.Millisecond, MaxWait: 10 * time.Second, StatusCodes: []int{502}}, policy)
+}
+
+func Test_RetryPolicy_backoff(t *testing.T) {
+	ass := assert.New(t)
+	policy := RetryPolicy{Wait: time.Second, MaxWait: 5 * time.Second}
+	low, high := func() float64 { return 0 }, func() float64 { return 1 }
+
+	ass.Equal(500*time.Millisecond, policy.backoff(1, low))
+	ass.Equal(time.Second, policy.backoff(1, high))
+	ass.Equal(4*time.Second, policy.backoff(3, high))
+	ass.Equal(5*time.Second, policy.backoff(10, high))
+	ass.Equal(2500*time.Millisecond, policy.backoff(10, low))
+}
+
+func Test_retryTransport_retries_transient_errors(t *testing.T) {
+	ass := assert.New(t)
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	var waits []time.Duration
+	transport := newRetryTransport(http.DefaultTransport, RetryPolicy{MaxAttempts: 3, Wait: time.Second, MaxWait: time.Minute, StatusCodes: []int{502}}, nil)
+	transport.random = func() float64 { return 1 }
+	transport.sleep = func(_ context.Context, wait time.Duration) error {
+		waits = append(waits, wait)
+		return nil
+	}
+	client := &http.Client{Transport: transport}
+
+	response, err := client.Post(server.URL, "application/json", strings.NewReader(`{"username":"raymond"}`))
+
+	require.NoError(t, err)
+	ass.Equal(http.StatusCreated, response.StatusCode)
+	ass.Equal([]time.Duration{time.Second, 2 * time.Second}, waits)
+	ass.Equal([]string{`{"username":"raymond"}`, `{"username":"raymond"}`, `{"username":"raymond"}`}, bodies)
+
+	// beyond MaxAttempts, the last response is returned
+	bodies, waits = nil, nil
+	transport.policy.MaxAttempts = 2
+	response, err = client.Get(server.URL)
+	require.NoError(t, err)
+	ass.Equal(http.StatusBadGateway, response.StatusCode)
+	ass.Len(bodies, 2)
+	ass.Len(waits, 1)
+}
+
+// reusedBuffer is a request body whose buffer is reused once closed, like the pooled buffers of resty
+type reusedBuffer struct {
+	*bytes.Reader
+	buffer []byte
+}
+
+func (body reusedBuffer) Close() error {
+	for i := range body.buffer {
+		body.buffer[i] = 'x'
+	}
+	return nil
+}
+
+func Test_retryTransport_retries_with_the_original_body(t *testing.T) {
+	ass := assert.New(t)
+	var lock sync.Mutex
+	received := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		received[string(body)]++
+		if received[string(body)] == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	transport := newRetryTransport(http.DefaultTransport, RetryPolicy{MaxAttempts: 2, StatusCodes: []int{502}}, nil)
+	transport.sleep = func(context.Context, time.Duration) error { return nil }
+	client := &http.Client{Transport: transport}
+
+	var wg sync.WaitGroup
+	statusCodes := make([]int, 20)
+	for i := range statusCodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buffer := []byte(fmt.Sprintf(`{"username":"user-%d"}`, i))
+			request, err := http.NewRequest(http.MethodPost, server.URL, nil)
+			require.NoError(t, err)
+			request.Body = reusedBuffer{Reader: bytes.NewReader(buffer), buffer: buffer}
+			request.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(buffer)), nil }
+			request.ContentLength = int64(len(buffer))
+			response, err := client.Do(request)
+			require.NoError(t, err)
+			discard(response)
+			statusCodes[i] = response.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	expected := map[string]int{}
+	for i, statusCode := range statusCodes {
+		ass.Equal(http.StatusCreated, statusCode)
+		expected[fmt.Sprintf(`{"username":"user-%d"}`, i)] = 2
+	}
+	ass.Equal(expected, received)
+}
+
+func Test_retryTransport_doesnt_send_again_a_sent_post(t *testing.T) {
+	ass := assert.New(t)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		// the connection is reset once the request is received
+		connection, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		_ = connection.Close()
+	}))
+	defer server.Close()
+	transport := newRetryTransport(http.DefaultTransport, RetryPolicy{MaxAttempts: 3}, nil)
+	transport.sleep = func(context.Context, time.Duration) error { return nil }
+	client := &http.Client{Transport: transport}
+
+	_, err := client.Post(server.URL, "application/json", strings.NewReader(`{"username":"raymond"}`))
+	ass.Error(err)
+	ass.Equal(1, attempts)
+
+	// a GET is sent again
+	attempts = 0
+	_, err = client.Get(server.URL)
+	ass.Error(err)
+	ass.Equal(3, attempts)
+
+	// a POST that couldn't connect is sent again
+	server.Close()
+	var waits int
+	transport.sleep = func(context.Context, time.Duration) error {
+		waits++
+		return nil
+	}
+	_, err = client.Post(server.URL, "application/json", strings.NewReader(`{"username":"raymond"}`))
+	ass.Error(err)
+	ass.Equal(2, waits)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"slices"
+	"strings"
 
 	"github.com/Nerzal/gocloak/v13"
 
@@ -60,20 +61,64 @@ func rolesFromGocloakRoles(roles []*gocloak.Role) Roles {
 	return r
 }
 
-func neededRoles(compositeRoles CompositeRoles, users Users) Roles {
-	var neededRoles Roles
-	for composite, roles := range compositeRoles {
-		neededRoles.add(composite)
-		for _, role := range roles {
-			neededRoles.add(role)
-		}
+// clientRoleSeparator separates the client from the role in the SCOPE column, e.g. datalake:lecteur
+const clientRoleSeparator = ":"
+
+// splitClientRole returns the client and the role of a client:role value, the default client if no client is given
+func splitClientRole(value string, defaultClient string) (string, string) {
+	if client, role, found := strings.Cut(value, clientRoleSeparator); found {
+		return strings.TrimSpace(client), strings.TrimSpace(role)
+	}
+	return defaultClient, value
+}
+
+// rolesByClient splits roles by client
+func rolesByClient(roles Roles, defaultClient string) CompositeRoles {
+	byClient := make(CompositeRoles)
+	for _, value := range roles {
+		client, role := splitClientRole(value, defaultClient)
+		byClient.addRole(client, role)
 	}
+	return byClient
+}
+
+// neededClientRoles returns by client the roles used by the stock and the composite roles,
+// the default client gets every zone, other clients the zones assigned in them
+func neededClientRoles(defaultClient string, compositeRoles CompositeRoles, users Users, habilitations CompositeRoles) CompositeRoles {
+	needed := CompositeRoles{defaultClient: nil}
 	for _, user := range users {
-		for _, role := range user.getRoles() {
-			neededRoles.add(role)
+		for client, roles := range user.getClientRoles(defaultClient, habilitations) {
+			for _, role := range roles {
+				needed.addRole(client, role)
+			}
+		}
+	}
+	for _, client := range sortedKeys(needed) {
+		for composite, roles := range clientCompositeRoles(client, defaultClient, compositeRoles, needed[client]) {
+			needed.addRole(client, composite)
+			for _, role := range roles {
+				needed.addRole(client, role)
+			}
 		}
 	}
-	return neededRoles
+	return needed
+}
+
+// clientCompositeRoles returns the composite roles of a client: every zone for the default client,
+// the zones assigned in the client for the others
+func clientCompositeRoles(client string, defaultClient string, compositeRoles CompositeRoles, roles Roles) CompositeRoles {
+	if client == defaultClient {
+		return compositeRoles
+	}
+	return selectMap(compositeRoles, func(zone string, _ Roles) bool { return roles.contains(zone) })
+}
+
+// qualifiedRoles prefixes roles of clients other than the default client, as in the SCOPE column
+func qualifiedRoles(client string, defaultClient string, roles Roles) Roles {
+	if client == defaultClient {
+		return roles
+	}
+	return mapSlice(roles, func(role string) string { return client + clientRoleSeparator + role })
 }
 
 // GetRoleFromRoleName resolves gocloak role object from a name
@@ -101,6 +146,7 @@ func (kc KeycloakContext) FindKeycloakRoles(clientName string, roles Roles) []go
 // ComposeRoles writes roles composition to keycloak server
 func (kc KeycloakContext) ComposeRoles(clientID string, compositeRoles CompositeRoles) error {
 	logContext := logger.ContextForMethod(kc.ComposeRoles).AddString("clientId", clientID)
+	failures := kc.newFailures()
 
 	// Add known roles
 	for role, roles := range compositeRoles {
@@ -125,6 +171,9 @@ func (kc KeycloakContext) ComposeRoles(clientID string, compositeRoles Composite
 		err := kc.API.AddClientRoleComposite(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), *gocloakRole.ID, gocloakRoles)
 		if err != nil {
 			logger.Error("erreur Keycloak", logContext, err)
+			if failures.add(OperationError{"ajout des rôles composites", role, err}) {
+				return failures.err()
+			}
 		}
 	}
 
@@ -132,6 +181,8 @@ func (kc KeycloakContext) ComposeRoles(clientID string, compositeRoles Composite
 	internalID, err := kc.GetInternalIDFromClientID(clientID)
 	if err != nil {
 		logger.Error("can't resolve client", logContext, err)
+		failures.add(err)
+		return failures.err()
 	}
 
 	for _, r := range kc.ClientRoles[clientID] {
@@ -139,6 +190,10 @@ func (kc KeycloakContext) ComposeRoles(clientID string, compositeRoles Composite
 		composingRoles, err := kc.API.GetCompositeClientRolesByRoleID(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalID, *r.ID)
 		if err != nil {
 			logger.Error("error when searching composite client role", logContext, err)
+			if failures.add(OperationError{"lecture des rôles composites", *r.Name, err}) {
+				return failures.err()
+			}
+			continue
 		}
 		wantedRoles := compositeRoles[*r.Name]
 		var deleteRoles []gocloak.Role
@@ -152,10 +207,13 @@ func (kc KeycloakContext) ComposeRoles(clientID string, compositeRoles Composite
 			logger.Info("removing composing role(s)", logContext)
 			if err = kc.API.DeleteClientRoleComposite(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), *r.ID, deleteRoles); err != nil {
 				logger.Error("Error deleting client role composite", logContext, err)
+				if failures.add(OperationError{"retrait des rôles composites", *r.Name, err}) {
+					return failures.err()
+				}
 			}
 		}
 	}
-	return nil
+	return failures.err()
 }
 
 func (compositeRoles CompositeRoles) addRole(key, role string) {
@@ -43,3 +43,29 @@ func TestRoles_add_many_roles(t *testing.T) {
 	ass.Len(roles, 3)
 	ass.Contains(roles, first, second, third)
 }
+
+func Test_splitClientRole(t *testing.T) {
+	ass := assert.New(t)
+	client, role := splitClientRole("datalake:lecteur", "signauxfaibles")
+	ass.Equal("datalake", client)
+	ass.Equal("lecteur", role)
+	client, role = splitClientRole("score", "signauxfaibles")
+	ass.Equal("signauxfaibles", client)
+	ass.Equal("score", role)
+}
+
+func Test_neededClientRoles_composes_zones_per_client(t *testing.T) {
+	ass := assert.New(t)
+	compositeRoles := CompositeRoles{"Bretagne": {"22", "29"}, "Normandie": {"14", "50"}}
+	users := Users{
+		"raymond@example.com": {niveau: "b", accesGeographique: "Bretagne", scope: []string{"datalake:lecteur", "datalake:Normandie"}},
+	}
+
+	needed := neededClientRoles("signauxfaibles", compositeRoles, users, defaultHabilitations)
+
+	ass.ElementsMatch(Roles{"detection", "dgefp", "pge", "score", "Bretagne", "Normandie", "22", "29", "14", "50"}, needed["signauxfaibles"])
+	ass.ElementsMatch(Roles{"lecteur", "Normandie", "14", "50"}, needed["datalake"])
+	ass.Equal(CompositeRoles{"Normandie": {"14", "50"}}, clientCompositeRoles("datalake", "signauxfaibles", compositeRoles, needed["datalake"]))
+	ass.Equal(Roles{"datalake:lecteur"}, qualifiedRoles("datalake", "signauxfaibles", Roles{"lecteur"}))
+	ass.Equal(Roles{"score"}, qualifiedRoles("signauxfaibles", "signauxfaibles", Roles{"score"}))
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/tealeg/xlsx/v3"
+	"golang.org/x/text/encoding/ianaindex"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+// stockOptions holds the settings used to read the stock file
+type stockOptions struct {
+	duplicates DuplicatesStrategy
+	// separator and encoding only apply to csv files
+	separator rune
+	encoding  string
+	// aliases maps another header name, uppercased, to the expected header
+	aliases map[string]string
+	// extraColumns maps an extra column, uppercased, to a Keycloak attribute
+	extraColumns map[string]string
+}
+
+// managedAttributes are the Keycloak attributes filled from HEADERS columns
+var managedAttributes = []string{"goup_path", "fonction", "employeur", "segment"}
+
+var defaultStockOptions = stockOptions{duplicates: duplicatesError, separator: ',', encoding: "utf-8"}
+
+// stockOptionsFromConfig reads settings from the [stock] section, missing values take default values
+func stockOptionsFromConfig(stock structs.Stock) (stockOptions, error) {
+	options := defaultStockOptions
+	var err error
+	if options.duplicates, err = parseDuplicatesStrategy(stock.Duplicates); err != nil {
+		return stockOptions{}, err
+	}
+	if stock.CsvSeparator != "" {
+		if utf8.RuneCountInString(stock.CsvSeparator) != 1 {
+			return stockOptions{}, fmt.Errorf("le séparateur csv doit être un unique caractère : %q", stock.CsvSeparator)
+		}
+		options.separator, _ = utf8.DecodeRuneInString(stock.CsvSeparator)
+	}
+	if stock.CsvEncoding != "" {
+		if _, err = ianaindex.IANA.Encoding(stock.CsvEncoding); err != nil {
+			return stockOptions{}, fmt.Errorf("encodage csv inconnu : %s", stock.CsvEncoding)
+		}
+		options.encoding = stock.CsvEncoding
+	}
+	if len(stock.ExtraColumns) > 0 {
+		options.extraColumns = make(map[string]string)
+	}
+	for column, attribute := range stock.ExtraColumns {
+		column = strings.ToUpper(strings.TrimSpace(column))
+		if contains(stockHeaders(), column) {
+			return stockOptions{}, fmt.Errorf("la colonne supplémentaire %s est déjà une colonne du stock", column)
+		}
+		if attribute == "" || contains(managedAttributes, attribute) {
+			return stockOptions{}, fmt.Errorf("attribut Keycloak invalide pour la colonne %s : %q", column, attribute)
+		}
+		options.extraColumns[column] = attribute
+	}
+	if len(stock.HeaderAliases) > 0 {
+		options.aliases = make(map[string]string)
+	}
+	for alias, header := range stock.HeaderAliases {
+		header = strings.ToUpper(strings.TrimSpace(header))
+		if _, extra := options.extraColumns[header]; !extra && !contains(stockHeaders(), header) {
+			return stockOptions{}, fmt.Errorf("l'alias %s désigne une colonne inconnue : %s", alias, header)
+		}
+		options.aliases[strings.ToUpper(strings.TrimSpace(alias))] = header
+	}
+	return options, nil
+}
+
+// canonicalHeader returns the expected header name, ignoring case and spaces
+func (options stockOptions) canonicalHeader(cell string) string {
+	header := strings.ToUpper(strings.TrimSpace(cell))
+	if canonical, found := options.aliases[header]; found {
+		return canonical
+	}
+	return header
+}
+
+// sheet is a sheet of the stock file, with its non empty rows only
+type sheet struct {
+	name string
+	rows []numberedRow
+}
+
+type workbook []sheet
+
+func (wb workbook) sheet(name string) (sheet, bool) {
+	for _, s := range wb {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return sheet{}, false
+}
+
+// stockReaders maps each file extension to the function reading the stock
+var stockReaders = map[string]func(filename string, options stockOptions) (workbook, error){
+	".xlsx": readXlsx,
+	".ods":  readOds,
+	".csv":  readCsv,
+}
+
+// readWorkbook reads the stock file according to its extension, or the user files if it is a folder
+func readWorkbook(filename string, options stockOptions) (workbook, error) {
+	extension := strings.ToLower(filepath.Ext(filename))
+	reader, found := stockReaders[extension]
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		reader, found = readUsersFolder, true
+	}
+	if !found {
+		return nil, InvalidExcelFileError{msg: fmt.Sprintf("format de fichier stock non supporté : %s (xlsx, ods ou csv)", filename)}
+	}
+	wb, err := reader(filename, options)
+	if err != nil {
+		return nil, err
+	}
+	if len(wb) == 0 {
+		return nil, InvalidExcelFileError{msg: fmt.Sprintf("le fichier stock ne contient aucune page : %s", filename)}
+	}
+	// columns are then found by name, whatever their position
+	if len(wb[0].rows) > 0 {
+		wb[0].rows[0].cells = mapSlice(wb[0].rows[0].cells, options.canonicalHeader)
+	}
+	return wb, nil
+}
+
+func readXlsx(filename string, _ stockOptions) (workbook, error) {
+	xlFile, err := xlsx.OpenFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var wb workbook
+	for _, xlSheet := range xlFile.Sheets {
+		wb = append(wb, sheet{name: xlSheet.Name, rows: loadNumberedRows(xlSheet)})
+	}
+	return wb, nil
+}
+
+func loadNumberedRows(sheet *xlsx.Sheet) []numberedRow {
+	var rows []numberedRow
+	_ = sheet.ForEachRow(func(row *xlsx.Row) error {
+		var cells []string
+		_ = row.ForEachCell(func(cell *xlsx.Cell) error {
+			cells = append(cells, cell.Value)
+			return nil
+		})
+		if isNotEmpty(cells) {
+			rows = append(rows, numberedRow{number: row.GetCoordinate() + 1, cells: cells})
+		}
+		return nil
+	})
+	return rows
+}
+
+// readCsv reads users from a csv file, a csv having a single sheet, zones are those of the referentiel
+func readCsv(filename string, options stockOptions) (workbook, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+	content, err := decodeCsv(file, options.encoding)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(content)
+	reader.Comma = options.separator
+	reader.FieldsPerRecord = -1
+	var rows []numberedRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, InvalidExcelFileError{msg: "fichier csv illisible", err: err}
+		}
+		if isNotEmpty(record) {
+			line, _ := reader.FieldPos(0)
+			rows = append(rows, numberedRow{number: line, cells: record})
+		}
+	}
+	return workbook{{name: NOM_PREMIERE_PAGE, rows: rows}, referentielSheet()}, nil
+}
+
+// decodeCsv converts the content to utf-8, an optional byte order mark is ignored
+func decodeCsv(file io.Reader, encoding string) (io.Reader, error) {
+	if encoding == "" || strings.EqualFold(encoding, "utf-8") || strings.EqualFold(encoding, "utf8") {
+		buffered := bufio.NewReader(file)
+		if bom, err := buffered.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+			_, _ = buffered.Discard(3)
+		}
+		return buffered, nil
+	}
+	charset, err := ianaindex.IANA.Encoding(encoding)
+	if err != nil || charset == nil {
+		return nil, InvalidExcelFileError{msg: fmt.Sprintf("encodage csv non supporté : %s", encoding), err: err}
+	}
+	return charset.NewDecoder().Reader(file), nil
+}
+
+// referentielSheet presents the geographic referentiel as a zones sheet
+func referentielSheet() sheet {
+	zones := sheet{name: "zones", rows: []numberedRow{{number: 1, cells: ZONES_HEADERS}}}
+	for i, row := range referentiel.value {
+		zones.rows = append(zones.rows, numberedRow{
+			number: i + 2,
+			cells:  []string{row.Region, row.AncienneRegion, row.Departement},
+		})
+	}
+	return zones
+}
+
+const (
+	odsTableNamespace  = "urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+	odsTextNamespace   = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+	odsOfficeNamespace = "urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+)
+
+// readOds reads the sheets of the content.xml file of an OpenDocument spreadsheet
+func readOds(filename string, _ stockOptions) (workbook, error) {
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, InvalidExcelFileError{msg: "fichier ods illisible", err: err}
+	}
+	defer archive.Close()
+	content, err := archive.Open("content.xml")
+	if err != nil {
+		return nil, InvalidExcelFileError{msg: "fichier ods sans content.xml", err: err}
+	}
+	defer content.Close()
+	wb, err := parseOdsContent(content)
+	if err != nil {
+		return nil, InvalidExcelFileError{msg: "fichier ods illisible", err: err}
+	}
+	return wb, nil
+}
+
+func parseOdsContent(content io.Reader) (workbook, error) {
+	decoder := xml.NewDecoder(content)
+	var wb workbook
+	var rowNumber, rowRepeat, cellRepeat, paragraphs int
+	var cells []string
+	var cell strings.Builder
+	// value is the value of a date or number cell, whatever the format displayed in text:p
+	var value string
+	inCell, inParagraph := false, false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return wb, nil
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch {
+			case element.Name.Space == odsTableNamespace && element.Name.Local == "table":
+				wb = append(wb, sheet{name: odsAttribute(element, odsTableNamespace, "name")})
+				rowNumber = 0
+			case element.Name.Space == odsTableNamespace && element.Name.Local == "table-row":
+				cells = nil
+				rowRepeat = odsRepeat(element, "number-rows-repeated")
+			case element.Name.Space == odsTableNamespace && (element.Name.Local == "table-cell" || element.Name.Local == "covered-table-cell"):
+				cell.Reset()
+				value = odsValue(element)
+				cellRepeat = odsRepeat(element, "number-columns-repeated")
+				paragraphs = 0
+				inCell = true
+			case inCell && element.Name.Space == odsTextNamespace && element.Name.Local == "p":
+				if paragraphs > 0 {
+					cell.WriteString("\n")
+				}
+				paragraphs++
+				inParagraph = true
+			case inCell && element.Name.Space == odsTextNamespace && element.Name.Local == "s":
+				spaces, _ := strconv.Atoi(odsAttribute(element, odsTextNamespace, "c"))
+				cell.WriteString(strings.Repeat(" ", max(spaces, 1)))
+			case inCell && element.Name.Space == odsTextNamespace && element.Name.Local == "line-break":
+				cell.WriteString("\n")
+			}
+		case xml.CharData:
+			// formatting whitespace between tags isn't part of the value
+			if inParagraph {
+				cell.Write(element)
+			}
+		case xml.EndElement:
+			switch {
+			case element.Name.Space == odsTextNamespace && element.Name.Local == "p":
+				inParagraph = false
+			case element.Name.Space == odsTableNamespace && (element.Name.Local == "table-cell" || element.Name.Local == "covered-table-cell"):
+				text := cell.String()
+				if value != "" {
+					text = value
+				}
+				for i := 0; i < cellRepeat; i++ {
+					cells = append(cells, text)
+				}
+				inCell = false
+			case element.Name.Space == odsTableNamespace && element.Name.Local == "table-row" && len(wb) > 0:
+				if isNotEmpty(cells) {
+					current := &wb[len(wb)-1]
+					for i := 0; i < rowRepeat; i++ {
+						current.rows = append(current.rows, numberedRow{number: rowNumber + i + 1, cells: trimTrailingEmpty(cells)})
+					}
+				}
+				rowNumber += rowRepeat
+			}
+		}
+	}
+}
+
+func odsAttribute(element xml.StartElement, space string, local string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Space == space && attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// odsValue reads the value of a date or number cell, as a 2006-01-02 date or a number like xlsx cells,
+// it is empty for other cells whose value is their text
+func odsValue(element xml.StartElement) string {
+	switch odsAttribute(element, odsOfficeNamespace, "value-type") {
+	case "date":
+		date := odsAttribute(element, odsOfficeNamespace, "date-value")
+		if day, _, found := strings.Cut(date, "T"); found {
+			return day
+		}
+		return date
+	case "float", "percentage", "currency":
+		return odsAttribute(element, odsOfficeNamespace, "value")
+	}
+	return ""
+}
+
+// odsRepeat reads a repeat attribute, identical consecutive cells and rows being grouped
+func odsRepeat(element xml.StartElement, attribute string) int {
+	repeat, err := strconv.Atoi(odsAttribute(element, odsTableNamespace, attribute))
+	if err != nil || repeat < 1 {
+		return 1
+	}
+	return repeat
+}
+
+func trimTrailingEmpty(cells []string) []string {
+	end := len(cells)
+	for end > 0 && cells[end-1] == "" {
+		end--
+	}
+	return cells[:end]
+}
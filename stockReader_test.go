@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding/charmap"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+func writeTestCsv(t *testing.T, separator rune, rows [][]string) string {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Comma = separator
+	if err := writer.WriteAll(rows); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "stock.csv")
+	if err := os.WriteFile(filename, buffer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func Test_loadExcel_reads_csv_like_xlsx(t *testing.T) {
+	ass := assert.New(t)
+	expected, _, err := loadExcel("./userBase.xlsx", defaultStockOptions)
+	require.NoError(t, err)
+	rows := [][]string{HEADERS}
+	for _, username := range sortedKeys(expected) {
+		rows = append(rows, expected[username].excelRow(defaultStockOptions))
+	}
+	filename := writeTestCsv(t, ';', rows)
+
+	users, compositeRoles, err := loadExcel(filename, stockOptions{duplicates: duplicatesError, separator: ';'})
+
+	ass.NoError(err)
+	ass.Equal(expected, users)
+	ass.Equal(Roles{"67", "68"}, compositeRoles["Alsace"])
+}
+
+func Test_loadExcel_decodes_csv_encoding(t *testing.T) {
+	ass := assert.New(t)
+	row := []string{"A", "DGFIP", "Bretagne", "", "", "Hélène", "DUPONT", "helene@example.com", "", "", "", ""}
+	content := strings.Join(HEADERS, ",") + "\n" + strings.Join(row, ",") + "\n"
+	latin1, err := charmap.ISO8859_1.NewEncoder().String(content)
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "stock.csv")
+	require.NoError(t, os.WriteFile(filename, []byte(latin1), 0644))
+
+	options, err := stockOptionsFromConfig(structs.Stock{CsvEncoding: "ISO-8859-1"})
+	require.NoError(t, err)
+	users, _, err := loadExcel(filename, options)
+
+	ass.NoError(err)
+	ass.Equal("Hélène", users["helene@example.com"].prenom)
+
+	// the BOM added by Excel when saving as utf-8 csv is ignored
+	require.NoError(t, os.WriteFile(filename, []byte("\xef\xbb\xbf"+content), 0644))
+	users, _, err = loadExcel(filename, defaultStockOptions)
+	ass.NoError(err)
+	ass.Equal("Hélène", users["helene@example.com"].prenom)
+}
+
+func Test_stockOptionsFromConfig(t *testing.T) {
+	ass := assert.New(t)
+	options, err := stockOptionsFromConfig(structs.Stock{})
+	ass.NoError(err)
+	ass.Equal(defaultStockOptions, options)
+
+	options, err = stockOptionsFromConfig(structs.Stock{CsvSeparator: "\t", Duplicates: "merge"})
+	ass.NoError(err)
+	ass.Equal(stockOptions{duplicates: duplicatesMerge, separator: '\t', encoding: "utf-8"}, options)
+
+	_, err = stockOptionsFromConfig(structs.Stock{CsvSeparator: ";;"})
+	ass.Error(err)
+	_, err = stockOptionsFromConfig(structs.Stock{CsvEncoding: "inconnu"})
+	ass.Error(err)
+}
+
+const testOdsContent = `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content
+  xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+  xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+  xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+  <office:body>
+    <office:spreadsheet>
+      <table:table table:name="utilisateurs">
+        <table:table-row>
+          <table:table-cell><text:p>NIVEAU HABILITATION</text:p></table:table-cell>
+          <table:table-cell><text:p>ENTITES</text:p></table:table-cell>
+          <table:table-cell><text:p>ACCES GEOGRAPHIQUE</text:p></table:table-cell>
+          <table:table-cell><text:p>FONCTION</text:p></table:table-cell>
+          <table:table-cell><text:p>SEGMENT</text:p></table:table-cell>
+          <table:table-cell><text:p>PRENOM</text:p></table:table-cell>
+          <table:table-cell><text:p>NOM</text:p></table:table-cell>
+          <table:table-cell><text:p>ADRESSE MAIL</text:p></table:table-cell>
+          <table:table-cell><text:p>GOUP</text:p></table:table-cell>
+          <table:table-cell><text:p>SCOPE</text:p></table:table-cell>
+          <table:table-cell><text:p>BOARDS</text:p></table:table-cell>
+          <table:table-cell><text:p>TASKFORCE</text:p></table:table-cell>
+        </table:table-row>
+        <table:table-row table:number-rows-repeated="2">
+          <table:table-cell table:number-columns-repeated="1024"/>
+        </table:table-row>
+        <table:table-row>
+          <table:table-cell><text:p>A</text:p></table:table-cell>
+          <table:table-cell><text:p>DGFIP</text:p></table:table-cell>
+          <table:table-cell><text:p>Alsace</text:p></table:table-cell>
+          <table:table-cell table:number-columns-repeated="2"/>
+          <table:table-cell><text:p>Jean<text:s/>Pierre</text:p></table:table-cell>
+          <table:table-cell><text:p>DUPONT</text:p></table:table-cell>
+          <table:table-cell><text:p>jp.dupont@example.com</text:p></table:table-cell>
+          <table:table-cell/>
+          <table:table-cell><text:p>wekan</text:p></table:table-cell>
+          <table:table-cell table:number-columns-repeated="1012"/>
+        </table:table-row>
+      </table:table>
+      <table:table table:name="zones">
+        <table:table-row>
+          <table:table-cell><text:p>REGION</text:p></table:table-cell>
+          <table:table-cell><text:p>ANCIENNE REGION</text:p></table:table-cell>
+          <table:table-cell><text:p>DEPARTEMENT</text:p></table:table-cell>
+        </table:table-row>
+        <table:table-row>
+          <table:table-cell><text:p>Grand Est</text:p></table:table-cell>
+          <table:table-cell><text:p>Alsace</text:p></table:table-cell>
+          <table:table-cell office:value-type="float" office:value="67"><text:p>67</text:p></table:table-cell>
+        </table:table-row>
+      </table:table>
+    </office:spreadsheet>
+  </office:body>
+</office:document-content>`
+
+func writeTestOds(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "stock.ods")
+	file, err := os.Create(filename)
+	require.NoError(t, err)
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	writer, err := archive.Create("content.xml")
+	require.NoError(t, err)
+	_, err = writer.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, archive.Close())
+	return filename
+}
+
+func Test_loadExcel_reads_ods(t *testing.T) {
+	ass := assert.New(t)
+	filename := writeTestOds(t, testOdsContent)
+
+	users, compositeRoles, err := loadExcel(filename, defaultStockOptions)
+
+	ass.NoError(err)
+	ass.Equal(Users{"jp.dupont@example.com": {
+		niveau:            "a",
+		email:             "jp.dupont@example.com",
+		prenom:            "Jean pierre",
+		nom:               "DUPONT",
+		employeur:         "DGFIP",
+		accesGeographique: "Alsace",
+		scope:             Roles{"wekan"},
+	}}, users)
+	ass.Equal(map[string]Roles{"Grand Est": {"67"}, "Alsace": {"67"}}, compositeRoles)
+}
+
+func Test_validateExcel_numbers_ods_rows_like_the_spreadsheet(t *testing.T) {
+	ass := assert.New(t)
+	filename := writeTestOds(t, strings.Replace(testOdsContent, "jp.dupont@example.com", "jp.dupont", 1))
+
+	stockErrors, err := validateExcel(filename, defaultStockOptions, newStockRules(defaultHabilitations, nil, nil))
+
+	ass.NoError(err)
+	ass.Equal([]StockError{{NOM_PREMIERE_PAGE, 4, "ADRESSE MAIL", `adresse mail invalide "jp.dupont"`}}, stockErrors)
+}
+
+func Test_loadExcel_reads_ods_dates_whatever_their_format(t *testing.T) {
+	ass := assert.New(t)
+	content := strings.Replace(testOdsContent,
+		`<table:table-cell><text:p>TASKFORCE</text:p></table:table-cell>`,
+		`<table:table-cell><text:p>TASKFORCE</text:p></table:table-cell>
+          <table:table-cell><text:p>DEBUT</text:p></table:table-cell>
+          <table:table-cell><text:p>FIN</text:p></table:table-cell>`, 1)
+	content = strings.Replace(content,
+		`<table:table-cell table:number-columns-repeated="1012"/>`,
+		`<table:table-cell table:number-columns-repeated="2"/>
+          <table:table-cell office:value-type="date" office:date-value="2024-01-15"><text:p>15/01/24</text:p></table:table-cell>
+          <table:table-cell office:value-type="date" office:date-value="2024-12-31T00:00:00"><text:p>31 déc. 2024</text:p></table:table-cell>`, 1)
+	filename := writeTestOds(t, content)
+
+	users, _, err := loadExcel(filename, defaultStockOptions)
+
+	ass.NoError(err)
+	ass.Equal(time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local), users["jp.dupont@example.com"].debut)
+	ass.Equal(time.Date(2024, 12, 31, 0, 0, 0, 0, time.Local), users["jp.dupont@example.com"].fin)
+}
+
+func Test_readWorkbook_refuses_unknown_extension(t *testing.T) {
+	ass := assert.New(t)
+	_, err := readWorkbook("stock.txt", defaultStockOptions)
+	ass.ErrorAs(err, &InvalidExcelFileError{})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"keycloakUpdater/v2/pkg/logger"
+)
+
+// runSummary sums up the result of each part processed by a command
+type runSummary struct {
+	command string
+	target  string // target of the [targets] section, empty without target
+	start   time.Time
+	parts   []partResult
+}
+
+type partResult struct {
+	name     string
+	err      error
+	duration time.Duration
+}
+
+func newRunSummary(command string) *runSummary {
+	return &runSummary{command: command, start: time.Now()}
+}
+
+// run runs a part of the process and records its result, the error if any is wrapped in a SyncError
+func (summary *runSummary) run(part string, f func() error) error {
+	start := time.Now()
+	err := f()
+	if err != nil {
+		err = SyncError{part: part, err: err}
+	}
+	summary.parts = append(summary.parts, partResult{name: part, err: err, duration: time.Since(start)})
+	return err
+}
+
+// err combines the errors of the parts: nil if everything succeeded, PartialSyncError if at least one part succeeded
+func (summary *runSummary) err() error {
+	var succeeded []string
+	var failed []error
+	for _, part := range summary.parts {
+		if part.err != nil {
+			failed = append(failed, part.err)
+		} else {
+			succeeded = append(succeeded, part.name)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	err := joinErrors(failed)
+	if len(succeeded) > 0 {
+		return PartialSyncError{succeeded: succeeded, err: err}
+	}
+	return err
+}
+
+// report logs the structured summary of the command and prints it on standard output
+func (summary *runSummary) report(exitCode int) {
+	logContext := logger.ContextForMethod(summary.report).
+		AddString("command", summary.command).
+		AddInt("exitCode", exitCode).
+		AddString("duration", time.Since(summary.start).Round(time.Millisecond).String())
+	title := summary.command
+	if summary.target != "" {
+		logContext.AddString("target", summary.target)
+		title += " (cible " + summary.target + ")"
+	}
+	fmt.Printf("======= Résumé : %s, code de sortie %d\n", title, exitCode)
+	for _, part := range summary.parts {
+		status := "OK"
+		if part.err != nil {
+			status = "ERREUR"
+		}
+		logContext.AddString(part.name, status)
+		fmt.Printf("%-10s %-7s %s\n", part.name, status, part.duration.Round(time.Millisecond))
+	}
+	if exitCode == exitOK {
+		logger.Notice("résumé du traitement", logContext)
+	} else {
+		logger.Warn("résumé du traitement", logContext)
+	}
+}
+
+// exitCodeOf maps the error that stopped the command to an exit code
+func exitCodeOf(err error) int {
+	var syncError SyncError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &UsageError{}):
+		return exitUsage
+	case errors.As(err, &ChangesDetectedError{}):
+		return exitDiff
+	case errors.As(err, &PartialSyncError{}):
+		// checked before the causes of the failed part, which would give their own exit code otherwise
+		return exitPartial
+	case errors.As(err, &ConfigError{}):
+		return exitConfig
+	case errors.As(err, &InvalidExcelFileError{}):
+		return exitInvalidStock
+	case errors.As(err, &TooManyChangesError{}), errors.As(err, &TooManyDeletionsError{}):
+		return exitTooManyChanges
+	case errors.As(err, &syncError) && syncError.part == "keycloak":
+		return exitKeycloak
+	case errors.As(err, &syncError) && syncError.part == "wekan":
+		return exitWekan
+	default:
+		return exitError
+	}
+}
+
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return MultiError(errs)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_exitCodeOf(t *testing.T) {
+	ass := assert.New(t)
+	ass.Equal(exitOK, exitCodeOf(nil))
+	ass.Equal(exitError, exitCodeOf(errors.New("erreur")))
+	ass.Equal(exitUsage, exitCodeOf(UsageError{msg: "usage"}))
+	ass.Equal(exitDiff, exitCodeOf(ChangesDetectedError{changes: 2}))
+	ass.Equal(exitConfig, exitCodeOf(ConfigError{err: errors.New("config")}))
+	ass.Equal(exitInvalidStock, exitCodeOf(errors.Wrap(InvalidExcelFileError{msg: "stock"}, "lecture")))
+	ass.Equal(exitTooManyChanges, exitCodeOf(SyncError{part: "keycloak", err: TooManyChangesError{}}))
+	ass.Equal(exitKeycloak, exitCodeOf(SyncError{part: "keycloak", err: errors.New("keycloak")}))
+	ass.Equal(exitWekan, exitCodeOf(SyncError{part: "wekan", err: errors.New("wekan")}))
+	ass.Equal(exitWekan, exitCodeOf(SyncError{part: "wekan", err: UnknownBoardsError{slugs: []string{"tableau"}}}))
+}
+
+func Test_exitCodeOf_partial_run_ignores_the_cause_of_the_failed_part(t *testing.T) {
+	ass := assert.New(t)
+	wekanFailure := SyncError{part: "wekan", err: InvalidExcelFileError{msg: "stock"}}
+	ass.Equal(exitPartial, exitCodeOf(PartialSyncError{succeeded: []string{"keycloak"}, err: wekanFailure}))
+
+	targetFailure := errors.Wrap(SyncError{part: "keycloak", err: TooManyChangesError{}}, "cible dreets")
+	ass.Equal(exitPartial, exitCodeOf(targetsError([]string{"dgfip", "dreets"}, []error{nil, targetFailure})))
+}
+
+func Test_runSummary_err(t *testing.T) {
+	ass := assert.New(t)
+	ok := func() error { return nil }
+	ko := func() error { return errors.New("échec") }
+
+	summary := newRunSummary("sync")
+	ass.NoError(summary.run("keycloak", ok))
+	ass.NoError(summary.err())
+
+	ass.Error(summary.run("wekan", ko))
+	ass.Equal(exitPartial, exitCodeOf(summary.err()))
+
+	summary = newRunSummary("sync")
+	summary.run("keycloak", ko)
+	summary.run("wekan", ko)
+	err := summary.err()
+	ass.IsType(MultiError{}, err)
+	ass.Equal(exitKeycloak, exitCodeOf(err))
+}
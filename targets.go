@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"keycloakUpdater/v2/pkg/config"
+	"keycloakUpdater/v2/pkg/logger"
+)
+
+const targetUsage = "nom de la cible à traiter, toutes les cibles de la section [targets] par défaut"
+
+// targetName is the target asked with the --target option
+var targetName string
+
+// currentTarget is the target being processed, empty without [targets] section
+var currentTarget string
+
+// selectedTargets are the targets processed by the command
+var selectedTargets []string
+
+// selectTargets selects the targets to process, a single unnamed target without [targets] section
+func selectTargets(cmd command) ([]string, error) {
+	if !cmd.perTarget {
+		return []string{""}, nil
+	}
+	conf, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	names := config.TargetNames(conf)
+	if targetName != "" {
+		if _, found := conf.Targets[targetName]; !found {
+			return nil, UsageError{msg: "cible inconnue : " + targetName}
+		}
+		return []string{targetName}, nil
+	}
+	if len(names) == 0 {
+		return []string{""}, nil
+	}
+	return names, nil
+}
+
+// outputFilename inserts the target name before the extension of the written file when several targets are processed
+func outputFilename(filename string) string {
+	if len(selectedTargets) < 2 || currentTarget == "" {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + currentTarget + ext
+}
+
+// targetsError combines the errors of the targets: drifts detected by diff aren't failures
+func targetsError(targets []string, errs []error) error {
+	var succeeded []string
+	var failed []error
+	changes := 0
+	for i, err := range errs {
+		var changesDetected ChangesDetectedError
+		switch {
+		case err == nil:
+			succeeded = append(succeeded, targets[i])
+		case errors.As(err, &changesDetected):
+			succeeded = append(succeeded, targets[i])
+			changes += changesDetected.changes
+		default:
+			failed = append(failed, errors.Wrapf(err, "cible %s", targets[i]))
+		}
+	}
+	switch {
+	case len(failed) > 0 && len(succeeded) > 0:
+		return PartialSyncError{succeeded: succeeded, err: joinErrors(failed)}
+	case len(failed) > 0:
+		return joinErrors(failed)
+	case changes > 0:
+		return ChangesDetectedError{changes: changes}
+	default:
+		return nil
+	}
+}
+
+// reportTargets prints the exit code of each target and returns the overall one
+func reportTargets(targets []string, exitCodes []int, err error) int {
+	exitCode := exitCodeOf(err)
+	logContext := logger.ContextForMethod(reportTargets).AddInt("exitCode", exitCode)
+	fmt.Printf("======= Cibles : code de sortie %d\n", exitCode)
+	for i, target := range targets {
+		logContext.AddInt(target, exitCodes[i])
+		fmt.Printf("%-20s %d\n", target, exitCodes[i])
+	}
+	if exitCode == exitOK {
+		logger.Notice("résumé des cibles", logContext)
+	} else {
+		logger.Warn("résumé des cibles", logContext)
+	}
+	return exitCode
+}
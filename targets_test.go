@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_outputFilename_adds_target_when_several_targets_run(t *testing.T) {
+	ass := assert.New(t)
+	defer func() { currentTarget, selectedTargets = "", nil }()
+
+	ass.Equal("plan.json", outputFilename("plan.json"))
+
+	currentTarget, selectedTargets = "staging", []string{"staging"}
+	ass.Equal("plan.json", outputFilename("plan.json"))
+
+	selectedTargets = []string{"production", "staging"}
+	ass.Equal("plan.staging.json", outputFilename("plan.json"))
+	ass.Equal("out/export.staging.xlsx", outputFilename("out/export.xlsx"))
+}
+
+func Test_targetsError(t *testing.T) {
+	ass := assert.New(t)
+	targets := []string{"production", "staging", "tenant"}
+	keycloakError := SyncError{part: "keycloak", err: errors.New("keycloak")}
+
+	ass.NoError(targetsError(targets, []error{nil, nil, nil}))
+	ass.Equal(
+		ChangesDetectedError{changes: 5},
+		targetsError(targets, []error{ChangesDetectedError{changes: 2}, nil, ChangesDetectedError{changes: 3}}),
+	)
+
+	err := targetsError(targets, []error{nil, keycloakError, ChangesDetectedError{changes: 2}})
+	ass.Equal(exitPartial, exitCodeOf(err))
+	ass.ErrorContains(err, "production, tenant")
+
+	err = targetsError(targets, []error{keycloakError, keycloakError, keycloakError})
+	ass.Equal(exitKeycloak, exitCodeOf(err))
+	ass.ErrorContains(err, "cible staging")
+}
+
+func Test_loadConfig_returns_config_error_on_malformed_target_file(t *testing.T) {
+	ass := assert.New(t)
+	folder := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(folder, "config.toml"), []byte(`
+[stock]
+usersAndRolesFilename = "userBase.xlsx"
+
+[targets.broken]
+clientsAndRealmFolder = "broken.d"
+`), 0o600))
+	require.NoError(t, os.Mkdir(filepath.Join(folder, "broken.d"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(folder, "broken.d", "realm.toml"), []byte("[realm\nenabled = "), 0o600))
+	workingDirectory, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(folder))
+	defer func() {
+		currentTarget = ""
+		require.NoError(t, os.Chdir(workingDirectory))
+	}()
+	currentTarget = "broken"
+
+	_, err = loadConfig()
+
+	ass.Equal(exitConfig, exitCodeOf(err))
+	ass.ErrorContains(err, "de la cible broken")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/go-resty/resty/v2"
+
+	"keycloakUpdater/v2/pkg/logger"
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+// tokenRenewalMargin is the delay before expiration from which the admin token is renewed
+const tokenRenewalMargin = 30 * time.Second
+
+// adminClientID is the client used by LoginAdmin, the token is refreshed with the same client
+const adminClientID = "admin-cli"
+
+// adminToken keeps the admin token valid during long synchronizations:
+// it is refreshed before it expires, or asked again when the refresh token expired too
+type adminToken struct {
+	mutex            sync.Mutex
+	api              *gocloak.GoCloak
+	realm            string
+	clientID         string
+	clientSecret     string
+	login            func(ctx context.Context) (*gocloak.JWT, error)
+	now              func() time.Time
+	jwt              *gocloak.JWT
+	expiresAt        time.Time
+	refreshExpiresAt time.Time
+}
+
+// newAdminToken logs in with the access.ClientID service account if configured,
+// with the access.Username admin user otherwise
+func newAdminToken(api *gocloak.GoCloak, access structs.Keycloak, realm string) *adminToken {
+	token := &adminToken{api: api, realm: realm, clientID: adminClientID, now: time.Now}
+	token.login = func(ctx context.Context) (*gocloak.JWT, error) {
+		return api.LoginAdmin(ctx, access.Username, access.Password, realm)
+	}
+	if access.ClientID != "" {
+		token.clientID, token.clientSecret = access.ClientID, access.ClientSecret
+		token.login = func(ctx context.Context) (*gocloak.JWT, error) {
+			return api.LoginClient(ctx, access.ClientID, access.ClientSecret, realm)
+		}
+	}
+	return token
+}
+
+// connect asks for a first token
+func (t *adminToken) connect(ctx context.Context) (*gocloak.JWT, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	jwt, err := t.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t.store(jwt)
+	return jwt, nil
+}
+
+// accessToken returns a valid token, renewed if it expires soon
+func (t *adminToken) accessToken(ctx context.Context) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.now().Add(tokenRenewalMargin).Before(t.expiresAt) {
+		return t.jwt.AccessToken, nil
+	}
+	if err := t.renew(ctx); err != nil {
+		return "", err
+	}
+	return t.jwt.AccessToken, nil
+}
+
+// invalidate forces the renewal of the token refused by Keycloak, unless it was already renewed
+func (t *adminToken) invalidate(token string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.jwt != nil && t.jwt.AccessToken == token {
+		t.expiresAt = time.Time{}
+	}
+}
+
+func (t *adminToken) renew(ctx context.Context) error {
+	logContext := logger.ContextForMethod(t.renew).AddString("realm", t.realm).WithBufferOf(ctx)
+	if t.jwt.RefreshToken != "" && t.now().Add(tokenRenewalMargin).Before(t.refreshExpiresAt) {
+		logger.Debug("rafraîchit le token d'administration", logContext)
+		jwt, err := t.api.RefreshToken(ctx, t.jwt.RefreshToken, t.clientID, t.clientSecret, t.realm)
+		if err == nil {
+			t.store(jwt)
+			return nil
+		}
+		logger.Warn("le token d'administration n'a pas pu être rafraîchi, nouvelle connexion", logContext.Clone().AddAny("error", err.Error()))
+	}
+	logger.Debug("reconnecte l'utilisateur d'administration", logContext)
+	jwt, err := t.login(ctx)
+	if err != nil {
+		logger.Error("erreur pendant la reconnexion de l'utilisateur d'administration", logContext, err)
+		return err
+	}
+	t.store(jwt)
+	return nil
+}
+
+func (t *adminToken) store(jwt *gocloak.JWT) {
+	now := t.now()
+	t.jwt = jwt
+	t.expiresAt = now.Add(time.Duration(jwt.ExpiresIn) * time.Second)
+	t.refreshExpiresAt = now.Add(time.Duration(jwt.RefreshExpiresIn) * time.Second)
+}
+
+// renewTokenOnRequests plugs the token into the gocloak HTTP client: each authenticated request
+// gets a valid token, retryTransport retries those refused with a 401 status code
+func renewTokenOnRequests(client *resty.Client, token *adminToken) {
+	client.OnBeforeRequest(func(_ *resty.Client, request *resty.Request) error {
+		// requests without token are those asking for a token
+		if request.Token == "" {
+			return nil
+		}
+		accessToken, err := token.accessToken(request.Context())
+		if err != nil {
+			return err
+		}
+		request.SetAuthToken(accessToken)
+		return nil
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+// tokenServer fakes Keycloak: each login delivers a new token, the `refusé` token is rejected by the admin API
+func tokenServer(t *testing.T, grants *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/protocol/openid-connect/token") {
+			require.NoError(t, r.ParseForm())
+			grant := r.PostForm.Get("grant_type")
+			if r.PostForm.Get("client_id") != adminClientID {
+				grant += "/" + r.PostForm.Get("client_id")
+			}
+			*grants = append(*grants, grant)
+			token := r.PostForm.Get("grant_type") + "-" + strconv.Itoa(len(*grants))
+			require.NoError(t, json.NewEncoder(w).Encode(gocloak.JWT{
+				AccessToken:      token,
+				RefreshToken:     "refresh-" + token,
+				ExpiresIn:        60,
+				RefreshExpiresIn: 1800,
+			}))
+			return
+		}
+		if r.Header.Get("Authorization") == "Bearer refusé" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("[]"))
+	}))
+}
+
+func Test_adminToken_renews_before_expiry(t *testing.T) {
+	ass := assert.New(t)
+	var grants []string
+	server := tokenServer(t, &grants)
+	defer server.Close()
+	api := gocloak.NewClient(server.URL)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	token := newAdminToken(api, structs.Keycloak{Username: "admin", Password: "pwd"}, "master")
+	token.now = func() time.Time { return now }
+	_, err := token.connect(context.Background())
+	require.NoError(t, err)
+
+	accessToken, err := token.accessToken(context.Background())
+	require.NoError(t, err)
+	ass.Equal("password-1", accessToken)
+
+	// the token expires in less than 30 seconds, it is refreshed
+	now = now.Add(45 * time.Second)
+	accessToken, err = token.accessToken(context.Background())
+	require.NoError(t, err)
+	ass.Equal("refresh_token-2", accessToken)
+
+	// the refresh token expired, the user logs in again
+	now = now.Add(time.Hour)
+	accessToken, err = token.accessToken(context.Background())
+	require.NoError(t, err)
+	ass.Equal("password-3", accessToken)
+	ass.Equal([]string{"password", "refresh_token", "password"}, grants)
+}
+
+func Test_retryTransport_replays_once_on_401(t *testing.T) {
+	ass := assert.New(t)
+	var grants []string
+	server := tokenServer(t, &grants)
+	defer server.Close()
+	api := gocloak.NewClient(server.URL)
+	token := newAdminToken(api, structs.Keycloak{Username: "admin", Password: "pwd"}, "master")
+	renewTokenOnRequests(api.RestyClient(), token)
+	httpClient := api.RestyClient().GetClient()
+	httpClient.Transport = newRetryTransport(httpClient.Transport, defaultRetryPolicy, token)
+	_, err := token.connect(context.Background())
+	require.NoError(t, err)
+	// Keycloak refuses the current token, e.g. after a restart
+	token.jwt.AccessToken = "refusé"
+
+	_, err = api.GetUsers(context.Background(), "ignoré", "master", gocloak.GetUsersParams{})
+
+	ass.NoError(err)
+	ass.Equal([]string{"password", "refresh_token"}, grants)
+}
+
+func Test_adminToken_logs_in_with_client_credentials(t *testing.T) {
+	ass := assert.New(t)
+	var grants []string
+	server := tokenServer(t, &grants)
+	defer server.Close()
+	api := gocloak.NewClient(server.URL)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	token := newAdminToken(api, structs.Keycloak{ClientID: "keycloak-updater", ClientSecret: "secret"}, "signauxfaibles")
+	token.now = func() time.Time { return now }
+	_, err := token.connect(context.Background())
+	require.NoError(t, err)
+
+	now = now.Add(45 * time.Second)
+	_, err = token.accessToken(context.Background())
+
+	ass.NoError(err)
+	ass.Equal([]string{"client_credentials/keycloak-updater", "refresh_token/keycloak-updater"}, grants)
+	ass.Equal(Username(""), adminUsername(&structs.Keycloak{Username: "admin", ClientID: "keycloak-updater"}))
+	ass.Equal(Username("admin"), adminUsername(&structs.Keycloak{Username: "admin"}))
+}
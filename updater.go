@@ -6,6 +6,7 @@ import (
 	"slices"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/Nerzal/gocloak/v13"
 	"github.com/pkg/errors"
@@ -25,21 +26,24 @@ func UpdateKeycloak(
 ) error {
 	logContext := logger.ContextForMethod(UpdateKeycloak).AddString("client", clientId)
 
-	if _, exists := users[configuredUsername]; !exists {
-		return errors.Errorf(
-			"l'utilisateur passé dans la configuration n'est pas présent dans le fichier d'habilitations: %s",
-			configuredUsername,
-		)
-	}
-
-	if _, err := kc.GetUser(configuredUsername); err != nil {
-		return errors.Wrap(
-			err,
-			fmt.Sprintf(
-				"l'utilisateur passé dans la configuration n'existe pas dans Keycloak : %s",
+	// neither the admin user of another realm nor a service account can be disabled
+	if configuredUsername != "" && kc.managesLoginRealm() {
+		if _, exists := users[configuredUsername]; !exists {
+			return errors.Errorf(
+				"l'utilisateur passé dans la configuration n'est pas présent dans le fichier d'habilitations: %s",
 				configuredUsername,
-			),
-		)
+			)
+		}
+
+		if _, err := kc.GetUser(configuredUsername); err != nil {
+			return errors.Wrap(
+				err,
+				fmt.Sprintf(
+					"l'utilisateur passé dans la configuration n'existe pas dans Keycloak : %s",
+					configuredUsername,
+				),
+			)
+		}
 	}
 
 	logger.Info("START", logContext)
@@ -47,22 +51,31 @@ func UpdateKeycloak(
 
 	// checking users
 	logger.Info("checking users", logContext)
-	missing, obsolete, update, current := users.Compare(*kc)
-	changes := len(missing) + len(obsolete) + len(update)
-	keeps := len(current)
-	if sure := areYouSureTooApplyChanges(changes, keeps, maxChangesToAccept); !sure {
-		return errors.New("trop de modifications utilisateurs.")
+	now := time.Now()
+	if err := kc.checkChanges(users, maxChangesToAccept, now); err != nil {
+		return err
 	}
+	missing, obsolete, update, current := users.Compare(*kc)
+	toStamp, toDelete := kc.planRetention(users, now)
 
-	// gather roles, newRoles are created before users, oldRoles are deleted after users
+	// gather roles of each client, newRoles are created before users, oldRoles are deleted after users
 	logger.Info("checking roles", logContext)
-	neededRoles := neededRoles(compositeRoles, users)
-	newRoles, oldRoles := neededRoles.compare(kc.GetClientRoles()[clientId])
+	roleClients := kc.roleClients(clientId)
+	neededRoles := neededClientRoles(clientId, compositeRoles, users, kc.Habilitations)
+	newRoles, oldRoles := make(CompositeRoles), make(CompositeRoles)
+	for _, client := range roleClients {
+		newRoles[client], oldRoles[client] = neededRoles[client].compare(kc.GetClientRoles()[client])
+	}
 
 	logger.Info("starting keycloak configuration", logContext)
 	// realmName conf
-	if realm != nil {
-		kc.SaveMasterRealm(*realm)
+	if realm != nil || kc.RealmMissing {
+		if realm == nil {
+			realm = &gocloak.RealmRepresentation{}
+		}
+		if err := kc.SaveRealm(*realm); err != nil {
+			return errors.Wrap(err, "erreur pendant la mise à jour du realm")
+		}
 	}
 
 	// clients conf
@@ -70,65 +83,149 @@ func UpdateKeycloak(
 		return errors.Wrap(err, "error when saving clients")
 	}
 
-	i, err := kc.CreateClientRoles(clientId, newRoles)
+	for _, client := range roleClients {
+		clientLogContext := logContext.Clone().AddString("clientId", client)
+		i, err := kc.CreateClientRoles(client, newRoles[client])
+		if err != nil {
+			logger.Error("erreur pendant l'écriture des nouveaux rôles", clientLogContext, err)
+			return errors.Wrap(err, "erreur pendant l'écriture des nouveaux rôles")
+		}
+		if i > 0 {
+			slices.Sort(newRoles[client])
+			logger.Notice("rôles créés", clientLogContext.AddAny("size", i).AddArray("roles", newRoles[client]))
+		} else {
+			logger.Info("pas de rôle à créer", clientLogContext)
+		}
+	}
+
+	// realm roles and groups assigned by the stock
+	createdRealmRoles, err := kc.CreateRealmRoles()
 	if err != nil {
-		logger.Panic("erreur pendant l'écriture des nouveaux rôles", logContext, err)
+		logger.Error("erreur pendant la création des rôles du realm", logContext, err)
+		return errors.Wrap(err, "erreur pendant la création des rôles du realm")
 	}
-	if i > 0 {
-		slices.Sort(newRoles)
-		logger.Notice("rôles créés", logContext.Clone().AddAny("size", i).AddArray("roles", newRoles))
-	} else {
-		logger.Info("pas de rôle à créer", logContext)
+	if len(createdRealmRoles) > 0 {
+		logger.Notice("rôles du realm créés", logContext.Clone().AddArray("realmRoles", createdRealmRoles))
+	}
+	createdGroups, err := kc.CreateGroups()
+	if err != nil {
+		logger.Error("erreur pendant la création des groupes", logContext, err)
+		return errors.Wrap(err, "erreur pendant la création des groupes")
+	}
+	if len(createdGroups) > 0 {
+		logger.Notice("groupes créés", logContext.Clone().AddArray("groups", createdGroups))
 	}
 
+	// from here, with ContinueOnError, errors are collected and returned at the end
+	failures := kc.newFailures()
+
 	// check and adjust composite roles
-	if err = kc.ComposeRoles(clientId, compositeRoles); err != nil {
-		logger.Panic("erreur pendant l'écriture des rôles composés", logContext, err)
+	for _, client := range roleClients {
+		if err = kc.ComposeRoles(client, clientCompositeRoles(client, clientId, compositeRoles, neededRoles[client])); err != nil {
+			logger.Error("erreur pendant l'écriture des rôles composés", logContext.Clone().AddString("clientId", client), err)
+			if failures.add(err) {
+				return errors.Wrap(err, "erreur pendant l'écriture des rôles composés")
+			}
+		}
 	}
 
 	if err = kc.CreateUsers(missing, users, clientId); err != nil {
-		logger.Panic("erreur pendant la création des utilisateurs", logContext, err)
+		logger.Error("erreur pendant la création des utilisateurs", logContext, err)
+		if failures.add(err) {
+			return errors.Wrap(err, "erreur pendant la création des utilisateurs")
+		}
 	}
 
 	// disable obsolete users
 	if err = kc.DisableUsers(obsolete, clientId); err != nil {
-		logger.Panic("erreur pendant la désactivation des utilisateurs", logContext, err)
+		logger.Error("erreur pendant la désactivation des utilisateurs", logContext, err)
+		if failures.add(err) {
+			return errors.Wrap(err, "erreur pendant la désactivation des utilisateurs")
+		}
 	}
 	// enable existing but disabled users
 	if err = kc.EnableUsers(update); err != nil {
-		logger.Panic("erreur pendant l'activation des utilisateurs", logContext, err)
+		logger.Error("erreur pendant l'activation des utilisateurs", logContext, err)
+		if failures.add(err) {
+			return errors.Wrap(err, "erreur pendant l'activation des utilisateurs")
+		}
+	}
+
+	// delete users disabled for longer than the retention period
+	if err = kc.ApplyRetention(toStamp, toDelete, now); err != nil {
+		logger.Error("erreur pendant la suppression des utilisateurs désactivés", logContext, err)
+		if failures.add(err) {
+			return errors.Wrap(err, "erreur pendant la suppression des utilisateurs désactivés")
+		}
 	}
 
 	// make sure every on has correct roles
-	if err = kc.UpdateCurrentUsers(current, users, clientId); err != nil {
-		logger.Error("erreur pendant la mise à jour des utilisateurs", logContext, err)
+	// an error here doesn't prevent roles cleanup, it is returned at the end
+	updateErr := kc.UpdateCurrentUsers(current, users, clientId)
+	if updateErr != nil {
+		logger.Error("erreur pendant la mise à jour des utilisateurs", logContext, updateErr)
+		if !kc.ContinueOnError {
+			updateErr = errors.Wrap(updateErr, "erreur pendant la mise à jour des utilisateurs")
+		}
+		failures.add(updateErr)
 	}
 
 	// delete old roles
-	if len(oldRoles) > 0 {
-		sort.Strings(oldRoles)
-		logContext.AddArray("toDelete", oldRoles)
-		logger.Info("removing unused roles", logContext)
-		logContext.Remove("toDelete")
-		internalID, err := kc.GetInternalIDFromClientID(clientId)
-		if err != nil {
-			panic(err)
-		}
-		for _, role := range kc.FindKeycloakRoles(clientId, oldRoles) {
-			err = kc.API.DeleteClientRole(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalID, *role.Name)
-			if err != nil {
-				panic(err)
-			}
+	for _, client := range roleClients {
+		if err = kc.deleteClientRoles(client, oldRoles[client], failures); err != nil {
+			return err
 		}
-		err = kc.refreshClientRoles()
+	}
+	logger.Info("DONE", logContext)
+	if err = failures.err(); err != nil && kc.ContinueOnError {
+		logger.Warn("des opérations ont échoué", logContext.Clone().AddInt("failures", len(failures.errs)))
+	}
+	return err
+}
+
+// deleteClientRoles deletes unused roles of a client, with ContinueOnError failures are added to failures
+func (kc *KeycloakContext) deleteClientRoles(clientId string, oldRoles Roles, failures *failures) error {
+	if len(oldRoles) == 0 {
+		return nil
+	}
+	logContext := logger.ContextForMethod(kc.deleteClientRoles).AddString("client", clientId)
+	sort.Strings(oldRoles)
+	logContext.AddArray("toDelete", oldRoles)
+	logger.Info("removing unused roles", logContext)
+	logContext.Remove("toDelete")
+	internalID, err := kc.GetInternalIDFromClientID(clientId)
+	if err != nil {
+		return errors.Wrap(err, "erreur pendant la suppression des rôles inutilisés")
+	}
+	for _, role := range kc.FindKeycloakRoles(clientId, oldRoles) {
+		err = kc.API.DeleteClientRole(context.Background(), kc.JWT.AccessToken, kc.getRealmName(), internalID, *role.Name)
 		if err != nil {
-			panic(err)
+			logger.Error("erreur pendant la suppression du rôle", logContext.Clone().AddString("role", *role.Name), err)
+			if !kc.ContinueOnError {
+				return errors.Wrapf(err, "erreur pendant la suppression du rôle %s", *role.Name)
+			}
+			failures.add(OperationError{"suppression du rôle", *role.Name, err})
 		}
 	}
-	logger.Info("DONE", logContext)
+	if err = kc.refreshClientRoles(); err != nil {
+		return errors.Wrap(err, "erreur pendant la récupération des rôles")
+	}
 	return nil
 }
 
+// checkChanges refuses the update when it changes too many users, keeps none or deletes too many disabled users,
+// the dry-run runs the same check
+func (kc KeycloakContext) checkChanges(users Users, maxChangesToAccept int, now time.Time) error {
+	missing, obsolete, update, current := users.Compare(kc)
+	changes := len(missing) + len(obsolete) + len(update)
+	keeps := len(current)
+	if sure := areYouSureTooApplyChanges(changes, keeps, maxChangesToAccept); !sure {
+		return TooManyChangesError{changes: changes, keeps: keeps, max: maxChangesToAccept}
+	}
+	_, toDelete := kc.planRetention(users, now)
+	return kc.checkDeletions(toDelete)
+}
+
 func areYouSureTooApplyChanges(changes, keeps, acceptedChanges int) bool {
 	logContext := logger.ContextForMethod(areYouSureTooApplyChanges)
 	logger.Notice("utilisateurs à rajouter/supprimer/activer", logContext.Clone().AddInt("nombre", changes))
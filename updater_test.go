@@ -1,8 +1,12 @@
 package main
 
 import (
+	"net/http"
 	"testing"
+	"time"
 
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -45,3 +49,45 @@ func Test_areYouSureTooApplyChanges(t *testing.T) {
 		})
 	}
 }
+
+func Test_isNotFound(t *testing.T) {
+	ass := assert.New(t)
+	ass.True(isNotFound(errors.WithStack(&gocloak.APIError{Code: http.StatusNotFound})))
+	ass.False(isNotFound(&gocloak.APIError{Code: http.StatusUnauthorized}))
+	ass.False(isNotFound(nil))
+}
+
+func Test_managesLoginRealm(t *testing.T) {
+	ass := assert.New(t)
+	realm := "signauxfaibles"
+	kc := KeycloakContext{Realm: &gocloak.RealmRepresentation{Realm: &realm}}
+
+	ass.True(kc.managesLoginRealm())
+	kc.LoginRealm = realm
+	ass.True(kc.managesLoginRealm())
+	kc.LoginRealm = "master"
+	ass.False(kc.managesLoginRealm())
+}
+
+func Test_checkChanges_refuses_what_the_update_would_refuse(t *testing.T) {
+	ass := assert.New(t)
+	enabled := true
+	kept, added, other := "kept@example.com", "added@example.com", "other@example.com"
+	kc := KeycloakContext{Users: []*gocloak.User{{Username: &kept, Enabled: &enabled}}}
+	users := Users{
+		Username(kept):  {email: Username(kept)},
+		Username(added): {email: Username(added)},
+		Username(other): {email: Username(other)},
+	}
+	now := time.Now()
+
+	err := kc.checkChanges(users, 1, now)
+
+	ass.Equal(TooManyChangesError{changes: 2, keeps: 1, max: 1}, err)
+	ass.Equal(exitTooManyChanges, exitCodeOf(SyncError{part: "keycloak", err: err}))
+	ass.NoError(kc.checkChanges(users, 2, now))
+	ass.NoError(kc.checkChanges(users, 0, now))
+
+	delete(users, Username(kept))
+	ass.Equal(TooManyChangesError{changes: 3, keeps: 0, max: 0}, kc.checkChanges(users, 0, now))
+}
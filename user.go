@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/Nerzal/gocloak/v13"
 )
@@ -24,30 +25,38 @@ type User struct {
 	accesGeographique string
 	boards            []string
 	taskforces        []string
+	// attributes holds the Keycloak attributes read from the extra columns of the configuration
+	attributes map[string]string
+	// debut and fin bound the access period, fin included, a zero date doesn't bound
+	debut time.Time
+	fin   time.Time
+	// realmRoles and groups are the realm roles and Keycloak group paths of the user
+	realmRoles []string
+	groups     []string
 }
 
 // Users is the collection of wanted users
 type Users map[Username]User
 
-var habilitations = CompositeRoles{
-	"a": []string{"bdf", "detection", "dgefp", "pge", "score", "urssaf"},
-	"b": []string{"detection", "dgefp", "pge", "score"},
+// isActiveAt tells whether date is within the access period of the user
+func (user User) isActiveAt(at time.Time) bool {
+	if !user.debut.IsZero() && at.Before(user.debut) {
+		return false
+	}
+	return user.fin.IsZero() || at.Before(user.fin.AddDate(0, 0, 1))
+}
+
+// selectActive returns users whose access period includes date
+func (users Users) selectActive(at time.Time) Users {
+	return selectMapByValue(users, func(user User) bool { return user.isActiveAt(at) })
 }
 
-func (user User) getRoles() Roles {
+// getRoles returns the roles of the habilitation level according to the habilitations matrix,
+// the geographic access for a user with a level, and the scope
+func (user User) getRoles(habilitations CompositeRoles) Roles {
 	var roles Roles
-	if user.niveau == "" {
-		// TODO should return MisconfiguredUserError
-	}
-	roles = habilitations[user.niveau]
-	if strings.EqualFold("a", user.niveau) {
-		roles.add("urssaf", "dgefp", "bdf")
-	}
-	if strings.EqualFold("b", user.niveau) {
-		roles.add("dgefp")
-	}
-	if strings.EqualFold("a", user.niveau) || strings.EqualFold("b", user.niveau) {
-		roles.add("score", "detection", "pge")
+	if niveauRoles, found := habilitations[strings.ToLower(user.niveau)]; found {
+		roles.add(niveauRoles...)
 		if user.accesGeographique != "" {
 			roles.add(user.accesGeographique)
 		}
@@ -58,6 +67,49 @@ func (user User) getRoles() Roles {
 	return roles
 }
 
+// getClientRoles returns the user roles by client, client:role scopes target another client
+func (user User) getClientRoles(defaultClient string, habilitations CompositeRoles) CompositeRoles {
+	return rolesByClient(user.getRoles(habilitations), defaultClient)
+}
+
+// merge merges scopes, boards and taskforces of two rows of the same user,
+// columns with different values are returned
+func (user User) merge(other User) (User, []string) {
+	var conflicts []string
+	compare := func(column string, a string, b string) {
+		if a != b {
+			conflicts = append(conflicts, column)
+		}
+	}
+	compare("NIVEAU HABILITATION", user.niveau, other.niveau)
+	compare("PRENOM", user.prenom, other.prenom)
+	compare("NOM", user.nom, other.nom)
+	compare("SEGMENT", user.segment, other.segment)
+	compare("FONCTION", user.fonction, other.fonction)
+	compare("ENTITES", user.employeur, other.employeur)
+	compare("GOUP", user.goup, other.goup)
+	compare("ACCES GEOGRAPHIQUE", user.accesGeographique, other.accesGeographique)
+	compare("DEBUT", formatStockDate(user.debut), formatStockDate(other.debut))
+	compare("FIN", formatStockDate(user.fin), formatStockDate(other.fin))
+	for _, key := range sortedKeys(keysUnion(user.attributes, other.attributes)) {
+		compare(key, user.attributes[key], other.attributes[key])
+	}
+	merged := user
+	merged.scope = union(user.scope, other.scope)
+	merged.boards = union(user.boards, other.boards)
+	merged.taskforces = union(user.taskforces, other.taskforces)
+	merged.realmRoles = union(user.realmRoles, other.realmRoles)
+	merged.groups = union(user.groups, other.groups)
+	return merged, conflicts
+}
+
+func union(a []string, b []string) []string {
+	var r Roles
+	r.add(a...)
+	r.add(b...)
+	return r
+}
+
 // GetUser resolves existing user from its username
 func (kc KeycloakContext) GetUser(username Username) (gocloak.User, error) {
 	for _, u := range kc.Users {
@@ -69,12 +121,15 @@ func (kc KeycloakContext) GetUser(username Username) (gocloak.User, error) {
 }
 
 // Compare returns missing, obsoletes, disabled users from kc.Users from []user
+// users out of their access period are handled as missing from the stock
 func (users Users) Compare(kc KeycloakContext) ([]gocloak.User, []gocloak.User, []gocloak.User, []gocloak.User) {
 	var missing []User
 	var enable []gocloak.User
 	var obsolete []gocloak.User
 	var current []gocloak.User
 
+	users = users.selectActive(time.Now())
+
 	for _, u := range users {
 		kcu, err := kc.GetUser(u.email)
 		if err != nil {
@@ -118,6 +173,9 @@ func (user User) ToGocloakUser() gocloak.User {
 	if user.segment != "" {
 		attributes["segment"] = []string{user.segment}
 	}
+	for key, value := range user.attributes {
+		attributes[key] = []string{value}
+	}
 	email := string(user.email)
 	return gocloak.User{
 		Username:      &email,
@@ -130,6 +188,48 @@ func (user User) ToGocloakUser() gocloak.User {
 	}
 }
 
+// differsFrom tells whether the last name, first name or attributes of the Keycloak user must be updated
+func (user User) differsFrom(kcUser gocloak.User) bool {
+	attributes := user.ToGocloakUser().Attributes
+	return kcUser.LastName != nil && user.nom != *kcUser.LastName ||
+		kcUser.FirstName != nil && user.prenom != *kcUser.FirstName ||
+		!compareAttributes(kcUser.Attributes, attributes)
+}
+
+// attributesDrift lists differences of last name, first name and attributes as `key : Keycloak → stock`
+func (user User) attributesDrift(kcUser gocloak.User) []string {
+	var drifts []string
+	if kcUser.LastName != nil && user.nom != *kcUser.LastName {
+		drifts = append(drifts, fmt.Sprintf("nom : %q → %q", *kcUser.LastName, user.nom))
+	}
+	if kcUser.FirstName != nil && user.prenom != *kcUser.FirstName {
+		drifts = append(drifts, fmt.Sprintf("prénom : %q → %q", *kcUser.FirstName, user.prenom))
+	}
+	wanted := *user.ToGocloakUser().Attributes
+	actual := make(map[string][]string)
+	if kcUser.Attributes != nil {
+		actual = *kcUser.Attributes
+	}
+	for _, key := range sortedKeys(keysUnion(wanted, actual)) {
+		a, b := strings.Join(distinctSorted(actual[key]), ","), strings.Join(distinctSorted(wanted[key]), ",")
+		if a != b {
+			drifts = append(drifts, fmt.Sprintf("%s : %q → %q", key, a, b))
+		}
+	}
+	return drifts
+}
+
+func keysUnion[V any](a map[string]V, b map[string]V) map[string]bool {
+	union := make(map[string]bool)
+	for key := range a {
+		union[key] = true
+	}
+	for key := range b {
+		union[key] = true
+	}
+	return union
+}
+
 func compareAttributes(a *map[string][]string, b *map[string][]string) bool {
 	if a == nil && b == nil {
 		return true
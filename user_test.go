@@ -3,14 +3,16 @@ package main
 import (
 	"sort"
 	"testing"
+	"time"
 
+	"github.com/Nerzal/gocloak/v13"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestUser_roles_with_niveau_a(t *testing.T) {
 	ass := assert.New(t)
 	user := User{niveau: "a"}
-	actual := user.getRoles()
+	actual := user.getRoles(defaultHabilitations)
 	sort.Strings(actual)
 	expected := []string{"score", "detection", "pge", "urssaf", "dgefp", "bdf"}
 	sort.Strings(expected)
@@ -20,7 +22,7 @@ func TestUser_roles_with_niveau_a(t *testing.T) {
 func TestUser_roles_with_niveau_b(t *testing.T) {
 	ass := assert.New(t)
 	user := User{niveau: "b"}
-	actual := user.getRoles()
+	actual := user.getRoles(defaultHabilitations)
 	expected := []string{"score", "detection", "pge", "dgefp"}
 	ass.ElementsMatch(actual, expected)
 }
@@ -29,7 +31,7 @@ func TestUser_roles_with_scopes(t *testing.T) {
 	ass := assert.New(t)
 	scopes := []string{"first", "second"}
 	user := User{niveau: "0", scope: scopes}
-	actual := user.getRoles()
+	actual := user.getRoles(defaultHabilitations)
 
 	ass.Contains(actual, scopes[0])
 	ass.Contains(actual, scopes[1])
@@ -39,7 +41,7 @@ func TestUser_roles_with_acces_geographique_and_niveau_a(t *testing.T) {
 	ass := assert.New(t)
 	accessGeographique := "any where"
 	user := User{niveau: "A", accesGeographique: accessGeographique}
-	actual := user.getRoles()
+	actual := user.getRoles(defaultHabilitations)
 	ass.Contains(actual, accessGeographique)
 }
 
@@ -47,6 +49,64 @@ func TestUser_roles_with_acces_geographique_and_niveau_0(t *testing.T) {
 	ass := assert.New(t)
 	accessGeographique := "any where"
 	user := User{niveau: "0", accesGeographique: accessGeographique}
-	actual := user.getRoles()
+	actual := user.getRoles(defaultHabilitations)
 	ass.NotContains(actual, accessGeographique)
 }
+
+func TestUser_attributesDrift(t *testing.T) {
+	ass := assert.New(t)
+	user := User{nom: "DUPONT", prenom: "Raymond", fonction: "inspecteur", employeur: "DGFIP"}
+	nom, prenom := "DUPOND", "Raymond"
+	attributes := map[string][]string{"fonction": {"inspecteur"}, "employeur": {"URSSAF"}, "segment": {"sf"}}
+	kcUser := gocloak.User{LastName: &nom, FirstName: &prenom, Attributes: &attributes}
+
+	ass.Equal([]string{
+		`nom : "DUPOND" → "DUPONT"`,
+		`employeur : "URSSAF" → "DGFIP"`,
+		`segment : "sf" → ""`,
+	}, user.attributesDrift(kcUser))
+}
+
+func TestUsers_Compare_ignores_users_outside_their_access_period(t *testing.T) {
+	ass := assert.New(t)
+	enabled, disabled := true, false
+	expired, future, current, disabledUsername := "expired@example.com", "future@example.com", "current@example.com", "disabled@example.com"
+	yesterday, tomorrow := time.Now().AddDate(0, 0, -1), time.Now().AddDate(0, 0, 1)
+	kc := KeycloakContext{Users: []*gocloak.User{
+		{Username: &expired, Enabled: &enabled},
+		{Username: &current, Enabled: &enabled},
+		{Username: &disabledUsername, Enabled: &disabled},
+	}}
+	users := Users{
+		Username(expired):          {email: Username(expired), fin: yesterday.AddDate(0, 0, -1)},
+		Username(future):           {email: Username(future), debut: tomorrow},
+		Username(current):          {email: Username(current), debut: yesterday, fin: time.Now()},
+		Username(disabledUsername): {email: Username(disabledUsername), fin: yesterday.AddDate(0, 0, -1)},
+	}
+
+	missing, obsolete, enable, keep := users.Compare(kc)
+
+	ass.Empty(missing)
+	ass.Equal([]gocloak.User{*kc.Users[0]}, obsolete)
+	ass.Empty(enable)
+	ass.Equal([]gocloak.User{*kc.Users[1]}, keep)
+}
+
+func TestUser_isActiveAt_includes_end_date(t *testing.T) {
+	ass := assert.New(t)
+	user := User{debut: time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local), fin: time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local)}
+	ass.False(user.isActiveAt(time.Date(2024, 1, 14, 23, 59, 0, 0, time.Local)))
+	ass.True(user.isActiveAt(time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local)))
+	ass.True(user.isActiveAt(time.Date(2024, 1, 31, 23, 59, 0, 0, time.Local)))
+	ass.False(user.isActiveAt(time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local)))
+	ass.True(User{}.isActiveAt(time.Now()))
+}
+
+func TestUsers_selectScopeWekan_skips_users_outside_their_access_period(t *testing.T) {
+	ass := assert.New(t)
+	users := Users{
+		"expired@example.com": {email: "expired@example.com", scope: []string{"wekan"}, fin: time.Now().AddDate(0, 0, -2)},
+		"current@example.com": {email: "current@example.com", scope: []string{"wekan"}, fin: time.Now()},
+	}
+	ass.Equal([]Username{"current@example.com"}, keys(users.selectScopeWekan()))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+// declaredUser is a user described in a toml or yaml file of the stock.usersFolder folder
+type declaredUser struct {
+	Niveau            string    `toml:"niveau" yaml:"niveau"`
+	Email             string    `toml:"email" yaml:"email"`
+	Prenom            string    `toml:"prenom" yaml:"prenom"`
+	Nom               string    `toml:"nom" yaml:"nom"`
+	Segment           string    `toml:"segment" yaml:"segment"`
+	Fonction          string    `toml:"fonction" yaml:"fonction"`
+	Employeur         string    `toml:"employeur" yaml:"employeur"`
+	Goup              string    `toml:"goup" yaml:"goup"`
+	Scope             []string  `toml:"scope" yaml:"scope"`
+	AccesGeographique string    `toml:"accesGeographique" yaml:"accesGeographique"`
+	Boards            []string  `toml:"boards" yaml:"boards"`
+	Taskforces        []string  `toml:"taskforces" yaml:"taskforces"`
+	Debut             stockDate `toml:"debut" yaml:"debut"`
+	Fin               stockDate `toml:"fin" yaml:"fin"`
+	RealmRoles        []string  `toml:"realmRoles" yaml:"realmRoles"`
+	Groups            []string  `toml:"groups" yaml:"groups"`
+	// Attributes holds the Keycloak attributes of the extra columns of the configuration
+	Attributes map[string]string `toml:"attributes" yaml:"attributes"`
+}
+
+// stockDate is a date of a users file, written as a string or as a toml date
+type stockDate string
+
+func (date *stockDate) UnmarshalTOML(value any) error {
+	switch v := value.(type) {
+	case string:
+		*date = stockDate(v)
+	case time.Time:
+		*date = stockDate(v.Format("2006-01-02"))
+	default:
+		return errors.Errorf("date invalide : %v", value)
+	}
+	return nil
+}
+
+// declaredUsers is the content of a file, users are listed under the `users` key
+type declaredUsers struct {
+	Users []declaredUser `toml:"users" yaml:"users"`
+}
+
+// stockSource returns the users folder if configured, the stock file otherwise
+func stockSource(stock structs.Stock) string {
+	if stock.UsersFolder != "" {
+		return stock.UsersFolder
+	}
+	return stock.UsersAndRolesFilename
+}
+
+// readUsersFolder presents users of the toml and yaml files of the folder as a users sheet,
+// validation errors point to the file and line of each user
+func readUsersFolder(folder string, options stockOptions) (workbook, error) {
+	filenames, err := usersFolderFiles(folder)
+	if err != nil {
+		return nil, err
+	}
+	extraColumns := sortedKeys(options.extraColumns)
+	header := append(stockHeaders(), extraColumns...)
+	users := sheet{name: NOM_PREMIERE_PAGE, rows: []numberedRow{{number: 1, cells: header}}}
+	for _, filename := range filenames {
+		rows, err := readUsersFile(filename, mapSlice(extraColumns, func(column string) string { return options.extraColumns[column] }))
+		if err != nil {
+			return nil, InvalidExcelFileError{msg: "fichier utilisateurs illisible : " + filename, err: err}
+		}
+		users.rows = append(users.rows, rows...)
+	}
+	return workbook{users, referentielSheet()}, nil
+}
+
+func usersFolderFiles(folder string) ([]string, error) {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var filenames []string
+	for _, entry := range entries {
+		extension := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || !contains([]string{".toml", ".yaml", ".yml"}, extension) {
+			continue
+		}
+		filenames = append(filenames, filepath.Join(folder, entry.Name()))
+	}
+	slices.Sort(filenames)
+	return filenames, nil
+}
+
+func readUsersFile(filename string, extraAttributes []string) ([]numberedRow, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var declared declaredUsers
+	var lines []int
+	if strings.ToLower(filepath.Ext(filename)) == ".toml" {
+		if _, err = toml.Decode(string(content), &declared); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		lines = tomlUsersLines(content)
+	} else {
+		if declared, lines, err = decodeYamlUsers(content); err != nil {
+			return nil, err
+		}
+	}
+	rows := make([]numberedRow, 0, len(declared.Users))
+	for i, user := range declared.Users {
+		number := i + 1
+		if len(lines) == len(declared.Users) {
+			number = lines[i]
+		}
+		rows = append(rows, numberedRow{number: number, cells: user.row(extraAttributes), source: filename})
+	}
+	return rows, nil
+}
+
+// tomlUsersLines finds the line of each [[users]] table, as the toml decoder doesn't give positions
+func tomlUsersLines(content []byte) []int {
+	var lines []int
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		if string(bytes.TrimSpace(line)) == "[[users]]" {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+func decodeYamlUsers(content []byte) (declaredUsers, []int, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return declaredUsers{}, nil, errors.WithStack(err)
+	}
+	var declared declaredUsers
+	if err := document.Decode(&declared); err != nil {
+		return declaredUsers{}, nil, errors.WithStack(err)
+	}
+	var lines []int
+	if len(document.Content) > 0 {
+		root := document.Content[0]
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == "users" {
+				for _, node := range root.Content[i+1].Content {
+					lines = append(lines, node.Line)
+				}
+			}
+		}
+	}
+	return declared, lines, nil
+}
+
+// row returns the user in the order of stockHeaders followed by extra attributes, as a row of the Excel file
+func (user declaredUser) row(extraAttributes []string) []string {
+	values := map[string]string{
+		"NIVEAU HABILITATION": user.Niveau,
+		"ENTITES":             user.Employeur,
+		"ACCES GEOGRAPHIQUE":  user.AccesGeographique,
+		"FONCTION":            user.Fonction,
+		"SEGMENT":             user.Segment,
+		"PRENOM":              user.Prenom,
+		"NOM":                 user.Nom,
+		"ADRESSE MAIL":        user.Email,
+		"GOUP":                user.Goup,
+		"SCOPE":               strings.Join(user.Scope, ","),
+		"BOARDS":              strings.Join(user.Boards, ","),
+		"TASKFORCE":           strings.Join(user.Taskforces, ","),
+		"DEBUT":               string(user.Debut),
+		"FIN":                 string(user.Fin),
+		"ROLES REALM":         strings.Join(user.RealmRoles, ","),
+		"GROUPES":             strings.Join(user.Groups, ","),
+	}
+	row := mapSlice(stockHeaders(), func(header string) string { return values[header] })
+	return append(row, mapSlice(extraAttributes, func(attribute string) string { return user.Attributes[attribute] })...)
+}
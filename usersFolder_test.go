@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testUsersToml = `
+[[users]]
+niveau = "A"
+email = "Raymond.Dupont@example.com"
+prenom = "raymond"
+nom = "dupont"
+employeur = "DGFIP"
+accesGeographique = "Bretagne"
+scope = ["wekan"]
+boards = ["tableau-crp-bretagne"]
+taskforces = ["france relance"]
+
+[[users]]
+niveau = "b"
+email = "josette@example.com"
+prenom = "Josette"
+nom = "Durand"
+segment = "dreets"
+`
+
+const testUsersYaml = `
+users:
+  - niveau: A
+    email: jean@example.com
+    prenom: Jean
+    nom: Martin
+    fonction: chargé de mission
+    goup: /dreets
+    scope: [wekan, crp]
+  - email: sans-prenom@example.com
+`
+
+func writeTestUsersFolder(t *testing.T, files map[string]string) string {
+	folder := filepath.Join(t.TempDir(), "users.d")
+	require.NoError(t, os.Mkdir(folder, 0755))
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(folder, name), []byte(content), 0644))
+	}
+	return folder
+}
+
+func Test_loadExcel_reads_users_folder_like_xlsx(t *testing.T) {
+	ass := assert.New(t)
+	//               NIVEAU ENTITES ACCES FONCTION SEGMENT PRENOM NOM ADRESSE MAIL GOUP SCOPE BOARDS TASKFORCE
+	xlsxFilename := writeTestStock(t, [][]string{
+		{"A", "DGFIP", "Bretagne", "", "", "raymond", "dupont", "Raymond.Dupont@example.com", "", "wekan", "tableau-crp-bretagne", "france relance"},
+		{"b", "", "", "", "dreets", "Josette", "Durand", "josette@example.com", "", "", "", ""},
+		{"A", "", "", "chargé de mission", "", "Jean", "Martin", "jean@example.com", "/dreets", "wekan,crp", "", ""},
+		{"", "", "", "", "", "", "", "sans-prenom@example.com", "", "", "", ""},
+	}, nil)
+	expected, _, err := loadExcel(xlsxFilename, defaultStockOptions)
+	require.NoError(t, err)
+	folder := writeTestUsersFolder(t, map[string]string{
+		"dgfip.toml":  testUsersToml,
+		"dreets.yaml": testUsersYaml,
+		"README.md":   "ignoré",
+	})
+
+	users, compositeRoles, err := loadExcel(folder, defaultStockOptions)
+
+	ass.NoError(err)
+	ass.Equal(expected, users)
+	ass.Equal(Roles{"67", "68"}, compositeRoles["Alsace"])
+}
+
+func Test_validateExcel_locates_errors_in_users_files(t *testing.T) {
+	ass := assert.New(t)
+	folder := writeTestUsersFolder(t, map[string]string{
+		"dgfip.toml":  testUsersToml,
+		"dreets.yaml": testUsersYaml,
+	})
+
+	stockErrors, err := validateExcel(folder, defaultStockOptions, newStockRules(defaultHabilitations, []string{"crp"}, nil))
+
+	ass.NoError(err)
+	ass.Equal([]StockError{
+		{filepath.Join(folder, "dreets.yaml"), 10, "PRENOM", "prénom absent"},
+	}, stockErrors)
+}
+
+func Test_fileChecksum_covers_every_users_file(t *testing.T) {
+	ass := assert.New(t)
+	folder := writeTestUsersFolder(t, map[string]string{"dgfip.toml": testUsersToml})
+	before, err := fileChecksum(folder)
+	ass.NoError(err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(folder, "dreets.yaml"), []byte(testUsersYaml), 0644))
+	after, err := fileChecksum(folder)
+
+	ass.NoError(err)
+	ass.NotEqual(before, after)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"keycloakUpdater/v2/pkg/config"
+	"keycloakUpdater/v2/pkg/logger"
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+// stockRules holds the values accepted in the stock file, lowercased
+type stockRules struct {
+	zones  map[string]bool
+	scopes map[string]bool
+	// boards is nil when no board list is known, boards aren't checked then
+	boards map[string]bool
+	// realmRoles and groups are the realm roles and group paths of the configuration, case sensitive
+	realmRoles map[string]bool
+	groups     map[string]bool
+	// defaultClient gets scope roles, clients are the other clients accepted in the client:role syntax
+	defaultClient string
+	clients       map[string]bool
+	// admin is the Keycloak user of the configuration, its username isn't necessarily an email address
+	admin Username
+	// habilitations maps each accepted habilitation level to its roles
+	habilitations CompositeRoles
+	// duplicates tells whether duplicate addresses are errors or are handled by loadExcel
+	duplicates DuplicatesStrategy
+}
+
+// numberedRow is a non empty row of a sheet, numbered as in Excel
+type numberedRow struct {
+	number int
+	cells  []string
+	// source is the file the row comes from when the stock is split into several files
+	source string
+}
+
+// newStockRules accepts referentiel zones, habilitation levels and roles, wekan and configured scopes
+func newStockRules(habilitations CompositeRoles, scopes []string, boards []string) stockRules {
+	rules := stockRules{
+		zones:         make(map[string]bool),
+		scopes:        make(map[string]bool),
+		habilitations: habilitations,
+		duplicates:    duplicatesError,
+	}
+	for zone, departements := range referentiel.toRoles() {
+		rules.addZone(zone, departements)
+	}
+	for _, roles := range habilitations {
+		for _, role := range roles {
+			rules.scopes[strings.ToLower(role)] = true
+		}
+	}
+	rules.scopes["wekan"] = true
+	for _, scope := range scopes {
+		rules.scopes[strings.ToLower(scope)] = true
+	}
+	if boards != nil {
+		rules.boards = make(map[string]bool)
+		for _, board := range boards {
+			rules.boards[strings.ToLower(board)] = true
+		}
+	}
+	return rules
+}
+
+func (rules stockRules) addZone(zone string, departements Roles) {
+	rules.zones[strings.ToLower(zone)] = true
+	for _, departement := range departements {
+		rules.zones[strings.ToLower(departement)] = true
+	}
+}
+
+// stockRulesFromConfig builds the validation rules, boards are read from stock.boardsConfigFilename
+func stockRulesFromConfig(conf structs.Config) (stockRules, error) {
+	var err error
+	var boards []string
+	if conf.Stock.BoardsConfigFilename != "" {
+		boardsConfig, err := config.LoadBoardsConfig(conf.Stock.BoardsConfigFilename)
+		if err != nil {
+			return stockRules{}, err
+		}
+		boards = []string{}
+		for _, regionBoards := range boardsConfig {
+			for _, slugs := range regionBoards {
+				boards = append(boards, slugs...)
+			}
+		}
+	}
+	habilitations, err := resolveHabilitations(conf.Habilitations)
+	if err != nil {
+		return stockRules{}, err
+	}
+	rules := newStockRules(habilitations, conf.Stock.Scopes, boards)
+	rules.defaultClient = conf.Stock.ClientForRoles
+	rules.clients = make(map[string]bool)
+	for _, client := range conf.Stock.RoleClients {
+		rules.clients[client] = true
+	}
+	rules.realmRoles = make(map[string]bool)
+	for _, role := range conf.Stock.RealmRoles {
+		rules.realmRoles[role] = true
+	}
+	rules.groups = make(map[string]bool)
+	for _, group := range conf.Stock.Groups {
+		rules.groups[normalizeGroupPath(group)] = true
+	}
+	if rules.duplicates, err = parseDuplicatesStrategy(conf.Stock.Duplicates); err != nil {
+		return stockRules{}, err
+	}
+	if conf.Keycloak != nil {
+		rules.admin = Username(strings.ToLower(string(adminUsername(conf.Keycloak))))
+	}
+	return rules, nil
+}
+
+// validateExcel checks each row of the stock file and returns every error found
+func validateExcel(excelFileName string, options stockOptions, rules stockRules) ([]StockError, error) {
+	wb, err := readWorkbook(excelFileName, options)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkExcelFormat(wb, options); err != nil {
+		return nil, err
+	}
+	var stockErrors []StockError
+	zonesSheet, found := wb.sheet("zones")
+	if !found {
+		stockErrors = append(stockErrors, StockError{"zones", 1, "page", "la page zones est absente"})
+	} else {
+		stockErrors = append(stockErrors, rules.addZonesSheet(zonesSheet.rows)...)
+	}
+	stockErrors = append(stockErrors, rules.validateUsers(wb[0].rows)...)
+	return stockErrors, nil
+}
+
+// addZonesSheet adds the zones of the zones sheet to accepted zones
+func (rules stockRules) addZonesSheet(rows []numberedRow) []StockError {
+	if len(rows) == 0 {
+		return []StockError{{"zones", 1, "page", "la page zones est vide"}}
+	}
+	columns := columnsOf(rows[0])
+	var stockErrors []StockError
+	for _, header := range ZONES_HEADERS {
+		if _, ok := columns[header]; !ok {
+			stockErrors = append(stockErrors, StockError{"zones", rows[0].number, header, "colonne absente"})
+		}
+	}
+	if len(stockErrors) > 0 {
+		return stockErrors
+	}
+	for _, row := range rows[1:] {
+		departement := Roles{row.get(columns, "DEPARTEMENT")}
+		rules.addZone(row.get(columns, "REGION"), departement)
+		rules.addZone(row.get(columns, "ANCIENNE REGION"), departement)
+	}
+	return nil
+}
+
+// validateUsers checks the rows of the users sheet, the header is checked by checkSheet1Format
+func (rules stockRules) validateUsers(rows []numberedRow) []StockError {
+	if len(rows) == 0 {
+		return nil
+	}
+	columns := columnsOf(rows[0])
+	var stockErrors []StockError
+	emails := make(map[Username]int)
+	for _, row := range rows[1:] {
+		addError := func(column string, format string, a ...any) {
+			location := NOM_PREMIERE_PAGE
+			if row.source != "" {
+				location = row.source
+			}
+			stockErrors = append(stockErrors, StockError{location, row.number, column, fmt.Sprintf(format, a...)})
+		}
+		rawEmail := strings.TrimSpace(row.get(columns, "ADRESSE MAIL"))
+		email := Username(strings.ToLower(rawEmail))
+		if email == "" {
+			addError("ADRESSE MAIL", "adresse mail absente")
+		} else if address, err := mail.ParseAddress(rawEmail); email != rules.admin && (err != nil || address.Address != rawEmail) {
+			addError("ADRESSE MAIL", "adresse mail invalide %q", rawEmail)
+		} else if first, found := emails[email]; found && rules.duplicates == duplicatesError {
+			addError("ADRESSE MAIL", "adresse mail %s déjà présente ligne %d", email, first)
+		} else if !found {
+			emails[email] = row.number
+		}
+		if len(strings.TrimSpace(row.get(columns, "PRENOM"))) < 2 {
+			addError("PRENOM", "prénom absent")
+		}
+		niveau := strings.ToLower(strings.TrimSpace(row.get(columns, "NIVEAU HABILITATION")))
+		// 0 or empty: no habilitation, as for the admin user
+		if _, known := rules.habilitations[niveau]; !known && niveau != "" && niveau != "0" {
+			addError("NIVEAU HABILITATION", "niveau d'habilitation inconnu %q", niveau)
+		}
+		if zone := strings.TrimSpace(row.get(columns, "ACCES GEOGRAPHIQUE")); zone != "" && !rules.zones[strings.ToLower(zone)] {
+			addError("ACCES GEOGRAPHIQUE", "zone inconnue %q, absente du référentiel et de la page zones", zone)
+		}
+		for _, scope := range splitExcelValue(row.get(columns, "SCOPE"), ",") {
+			client, role := splitClientRole(scope, rules.defaultClient)
+			switch {
+			case client != rules.defaultClient && !rules.clients[client]:
+				addError("SCOPE", "client inconnu %q, absent de stock.roleClients", client)
+			case client != rules.defaultClient && role == "":
+				addError("SCOPE", "rôle absent pour le client %q", client)
+			case client == rules.defaultClient && !rules.scopes[strings.ToLower(role)] && !rules.zones[strings.ToLower(role)]:
+				addError("SCOPE", "scope inconnu %q", scope)
+			}
+		}
+		for _, role := range splitExcelValue(row.get(columns, "ROLES REALM"), ",") {
+			if !rules.realmRoles[role] {
+				addError("ROLES REALM", "rôle du realm inconnu %q, absent de stock.realmRoles", role)
+			}
+		}
+		for _, group := range splitGroupPaths(row.get(columns, "GROUPES")) {
+			if !rules.groups[group] {
+				addError("GROUPES", "groupe inconnu %q, absent de stock.groups", group)
+			}
+		}
+		debut, debutErr := parseStockDate(row.get(columns, "DEBUT"))
+		if debutErr != nil {
+			addError("DEBUT", "%s", debutErr)
+		}
+		fin, finErr := parseStockDate(row.get(columns, "FIN"))
+		if finErr != nil {
+			addError("FIN", "%s", finErr)
+		}
+		if !debut.IsZero() && !fin.IsZero() && fin.Before(debut) {
+			addError("FIN", "fin d'accès %s antérieure au début %s", formatStockDate(fin), formatStockDate(debut))
+		}
+		if rules.boards != nil {
+			for _, board := range splitExcelValue(row.get(columns, "BOARDS"), ",") {
+				if !rules.boards[strings.ToLower(board)] {
+					addError("BOARDS", "tableau inconnu %q", board)
+				}
+			}
+		}
+	}
+	return stockErrors
+}
+
+// validateStock rejects the stock if it has at least one error, each error is logged
+func validateStock(conf structs.Config) error {
+	logContext := logger.ContextForMethod(validateStock).AddString("filename", stockSource(*conf.Stock))
+	rules, err := stockRulesFromConfig(conf)
+	if err != nil {
+		return ConfigError{err: err}
+	}
+	options, err := stockOptionsFromConfig(*conf.Stock)
+	if err != nil {
+		return ConfigError{err: err}
+	}
+	stockErrors, err := validateExcel(stockSource(*conf.Stock), options, rules)
+	if err != nil {
+		return err
+	}
+	if len(stockErrors) == 0 {
+		return nil
+	}
+	errs := make([]error, 0, len(stockErrors))
+	for _, stockError := range stockErrors {
+		logger.Error("erreur dans le fichier stock", logContext, stockError)
+		errs = append(errs, stockError)
+	}
+	return InvalidExcelFileError{
+		msg: fmt.Sprintf("%d erreur(s) dans le fichier stock %s", len(stockErrors), stockSource(*conf.Stock)),
+		err: joinErrors(errs),
+	}
+}
+
+// columnsOf maps each header to its position, the last occurrence wins as in loadExcel
+func columnsOf(header numberedRow) map[string]int {
+	columns := make(map[string]int)
+	for i, name := range header.cells {
+		columns[name] = i
+	}
+	return columns
+}
+
+func (row numberedRow) get(columns map[string]int, column string) string {
+	i, ok := columns[column]
+	if !ok || i >= len(row.cells) {
+		return ""
+	}
+	return row.cells[i]
+}
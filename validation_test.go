@@ -0,0 +1,137 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tealeg/xlsx/v3"
+
+	"keycloakUpdater/v2/pkg/structs"
+)
+
+func writeTestStock(t *testing.T, users [][]string, zones [][]string) string {
+	return writeTestStockWithHeader(t, HEADERS, users, zones)
+}
+
+func writeTestStockWithHeader(t *testing.T, header []string, users [][]string, zones [][]string) string {
+	file := xlsx.NewFile()
+	sheet, _ := file.AddSheet(NOM_PREMIERE_PAGE)
+	addRow(sheet, header)
+	for _, user := range users {
+		addRow(sheet, user)
+	}
+	zonesSheet, _ := file.AddSheet("zones")
+	addRow(zonesSheet, ZONES_HEADERS)
+	for _, zone := range zones {
+		addRow(zonesSheet, zone)
+	}
+	filename := filepath.Join(t.TempDir(), "stock.xlsx")
+	if err := file.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func Test_validateExcel_reports_every_error_with_its_location(t *testing.T) {
+	ass := assert.New(t)
+	//                 NIVEAU ENTITES ACCES FONCTION SEGMENT PRENOM NOM ADRESSE MAIL GOUP SCOPE BOARDS TASKFORCE
+	filename := writeTestStock(t, [][]string{
+		{"A", "DGFIP", "Bretagne", "", "", "Raymond", "DUPONT", "raymond@example.com", "", "wekan", "tableau-crp-bfc", ""},
+		{"Z", "DGFIP", "Atlantide", "", "", "J", "DUPONT", "josette.example.com", "", "inconnu", "", ""},
+		{"b", "DGFIP", "zone perso", "", "", "Raymonde", "DUPONT", " Raymond@Example.com ", "", "", "tableau-inconnu", ""},
+		{"0", "SYSTEME", "", "", "", "kcadmin", "", "kcadmin", "", "", "", ""},
+	}, [][]string{{"Zone perso", "Zone perso", "999"}})
+	rules := newStockRules(defaultHabilitations, []string{"crp"}, []string{"tableau-crp-bfc"})
+	rules.admin = "kcadmin"
+
+	stockErrors, err := validateExcel(filename, defaultStockOptions, rules)
+
+	ass.NoError(err)
+	ass.Equal([]StockError{
+		{NOM_PREMIERE_PAGE, 3, "ADRESSE MAIL", `adresse mail invalide "josette.example.com"`},
+		{NOM_PREMIERE_PAGE, 3, "PRENOM", "prénom absent"},
+		{NOM_PREMIERE_PAGE, 3, "NIVEAU HABILITATION", `niveau d'habilitation inconnu "z"`},
+		{NOM_PREMIERE_PAGE, 3, "ACCES GEOGRAPHIQUE", `zone inconnue "Atlantide", absente du référentiel et de la page zones`},
+		{NOM_PREMIERE_PAGE, 3, "SCOPE", `scope inconnu "inconnu"`},
+		{NOM_PREMIERE_PAGE, 4, "ADRESSE MAIL", "adresse mail raymond@example.com déjà présente ligne 2"},
+		{NOM_PREMIERE_PAGE, 4, "BOARDS", `tableau inconnu "tableau-inconnu"`},
+	}, stockErrors)
+}
+
+func Test_validateExcel_skips_boards_without_boards_list(t *testing.T) {
+	ass := assert.New(t)
+	filename := writeTestStock(t, [][]string{
+		{"A", "DGFIP", "", "", "", "Raymond", "DUPONT", "raymond@example.com", "", "", "tableau-quelconque", ""},
+	}, nil)
+
+	stockErrors, err := validateExcel(filename, defaultStockOptions, newStockRules(defaultHabilitations, nil, nil))
+
+	ass.NoError(err)
+	ass.Empty(stockErrors)
+}
+
+func Test_validateExcel_checks_client_roles(t *testing.T) {
+	ass := assert.New(t)
+	filename := writeTestStock(t, [][]string{
+		{"A", "DGFIP", "", "", "", "Raymond", "DUPONT", "raymond@example.com", "", "datalake:lecteur,signauxfaibles:score", "", ""},
+		{"A", "DGFIP", "", "", "", "Josette", "DUPONT", "josette@example.com", "", "inconnu:lecteur,datalake:", "", ""},
+	}, nil)
+	rules, err := stockRulesFromConfig(structs.Config{Stock: &structs.Stock{
+		ClientForRoles: "signauxfaibles",
+		RoleClients:    []string{"datalake"},
+	}})
+	ass.NoError(err)
+
+	stockErrors, err := validateExcel(filename, defaultStockOptions, rules)
+
+	ass.NoError(err)
+	ass.Equal([]StockError{
+		{NOM_PREMIERE_PAGE, 3, "SCOPE", `client inconnu "inconnu", absent de stock.roleClients`},
+		{NOM_PREMIERE_PAGE, 3, "SCOPE", `rôle absent pour le client "datalake"`},
+	}, stockErrors)
+}
+
+func Test_validateExcel_accepts_the_shipped_samples(t *testing.T) {
+	ass := assert.New(t)
+	// configuration of the local Keycloak container, whose admin user is in the samples, with the `et` scope of the samples
+	rules, err := stockRulesFromConfig(structs.Config{
+		Keycloak: &structs.Keycloak{Username: "kcadmin"},
+		Stock:    &structs.Stock{ClientForRoles: "signauxfaibles", Scopes: []string{"et"}},
+	})
+	ass.NoError(err)
+
+	for _, filename := range []string{"./userBase.xlsx", "./test/sample/userBase.xlsx"} {
+		stockErrors, err := validateExcel(filename, defaultStockOptions, rules)
+
+		ass.NoError(err, filename)
+		ass.Empty(stockErrors, filename)
+	}
+}
+
+func Test_validateExcel_rejects_unconfigured_scope_of_the_shipped_samples(t *testing.T) {
+	ass := assert.New(t)
+	rules, err := stockRulesFromConfig(structs.Config{
+		Keycloak: &structs.Keycloak{Username: "kcadmin"},
+		Stock:    &structs.Stock{ClientForRoles: "signauxfaibles"},
+	})
+	ass.NoError(err)
+
+	stockErrors, err := validateExcel("./userBase.xlsx", defaultStockOptions, rules)
+
+	ass.NoError(err)
+	ass.Equal([]StockError{{NOM_PREMIERE_PAGE, 2, "SCOPE", `scope inconnu "et"`}}, stockErrors)
+}
+
+func Test_stockRulesFromConfig_uses_the_configured_habilitations(t *testing.T) {
+	ass := assert.New(t)
+	rules, err := stockRulesFromConfig(structs.Config{
+		Stock:         &structs.Stock{ClientForRoles: "signauxfaibles"},
+		Habilitations: map[string]structs.Habilitation{"C": {Roles: []string{"ctrl"}}},
+	})
+
+	ass.NoError(err)
+	ass.Equal(CompositeRoles{"c": {"ctrl"}}, rules.habilitations)
+	ass.True(rules.scopes["ctrl"])
+	ass.False(rules.scopes["bdf"])
+}
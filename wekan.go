@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/signaux-faibles/libwekan"
 
@@ -101,7 +100,7 @@ func checkBoardSlugs(wekan libwekan.Wekan, users Users) error {
 	_, _, onlyConfig := intersect(domainActiveSlugs, configSlugs)
 
 	if len(onlyConfig) > 0 {
-		return InvalidExcelFileError{msg: fmt.Sprintf("le fichier contient des références de boards inexistantes : %s", onlyConfig)}
+		return UnknownBoardsError{slugs: mapSlice(onlyConfig, func(slug libwekan.BoardSlug) string { return string(slug) })}
 	}
 	return nil
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/signaux-faibles/libwekan"
+
+	"keycloakUpdater/v2/pkg/logger"
+)
+
+// exportWekan fills boards and taskforce labels of users from the state of Wekan
+func exportWekan(wekan libwekan.Wekan, users Users) (Users, error) {
+	logContext := logger.ContextForMethod(exportWekan)
+	domainBoards, err := wekan.SelectDomainBoards(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	boards := make(map[Username][]string)
+	taskforces := make(map[Username][]string)
+	for _, board := range selectSlice(domainBoards, func(board libwekan.Board) bool { return !board.Archived }) {
+		members, err := wekan.GetUsersFromIDs(context.Background(), mapSlice(board.Members, func(member libwekan.BoardMember) libwekan.UserID { return member.UserID }))
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			if board.UserIsActiveMember(member) && selectGenuineUserFunc(wekan)(member) && !IsAdminUser(wekan, member) {
+				username := Username(strings.ToLower(string(member.Username)))
+				boards[username] = append(boards[username], string(board.Slug))
+			}
+		}
+		rules, err := wekan.SelectRulesFromBoardID(context.Background(), board.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range taskforceRulesOf(board, rules) {
+			if rule.Action == "addMember" {
+				username := Username(strings.ToLower(string(rule.Username)))
+				taskforces[username] = append(taskforces[username], string(rule.Label))
+			}
+		}
+	}
+	logger.Info("état de Wekan exporté", logContext.AddInt("members", len(boards)))
+	return withWekanMemberships(users, boards, taskforces), nil
+}
+
+// withWekanMemberships replaces boards and taskforces of users with those found in Wekan
+func withWekanMemberships(users Users, boards map[Username][]string, taskforces map[Username][]string) Users {
+	logContext := logger.ContextForMethod(withWekanMemberships)
+	exported := maps.Clone(users)
+	for username, user := range exported {
+		user.boards = distinctSorted(boards[username])
+		user.taskforces = distinctSorted(taskforces[username])
+		if len(user.boards) > 0 && !contains(user.scope, "wekan") {
+			logger.Warn("membre de tableaux Wekan sans le scope wekan", logContext.Clone().AddAny("username", username))
+		}
+		exported[username] = user
+	}
+	for _, username := range sortedKeys(boards) {
+		if _, ok := exported[username]; !ok {
+			logger.Warn("membre de tableaux Wekan absent du stock, ignoré", logContext.Clone().AddAny("username", username))
+		}
+	}
+	return exported
+}
+
+func distinctSorted(values []string) []string {
+	var distinct Roles
+	distinct.add(values...)
+	slices.Sort(distinct)
+	return distinct
+}
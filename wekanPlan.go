@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/signaux-faibles/libwekan"
+
+	"keycloakUpdater/v2/pkg/logger"
+)
+
+// WekanPlan describes the changes the Wekan pipeline would apply
+type WekanPlan struct {
+	UsersToCreate  []libwekan.Username  `json:"usersToCreate"`
+	UsersToEnable  []libwekan.Username  `json:"usersToEnable"`
+	UsersToDisable []libwekan.Username  `json:"usersToDisable"`
+	BoardsMembers  []BoardMembersChange `json:"boardsMembers"`
+	RulesToAdd     []TaskforceRule      `json:"rulesToAdd"`
+	RulesToRemove  []TaskforceRule      `json:"rulesToRemove"`
+}
+
+// BoardMembersChange describes planned additions and removals of board members
+type BoardMembersChange struct {
+	Board  libwekan.BoardSlug  `json:"board"`
+	Add    []libwekan.Username `json:"add"`
+	Remove []libwekan.Username `json:"remove"`
+}
+
+// TaskforceRule identifies a rule adding or removing a user on cards with a label
+type TaskforceRule struct {
+	Board    libwekan.BoardSlug      `json:"board"`
+	Label    libwekan.BoardLabelName `json:"label"`
+	Username libwekan.Username       `json:"username"`
+	Action   string                  `json:"action"`
+}
+
+// PlanWekan computes the changes to apply to Wekan without calling any write method
+func PlanWekan(wekan libwekan.Wekan, users Users) (WekanPlan, error) {
+	logContext := logger.ContextForMethod(PlanWekan)
+	logger.Info("calcule les modifications Wekan", logContext)
+	if err := checkBoardSlugs(wekan, users); err != nil {
+		return WekanPlan{}, err
+	}
+	fromConfig := maps.Clone(users)
+	addAdmin(fromConfig, wekan)
+
+	plan := WekanPlan{}
+	fromWekan, err := selectWekanUsers(wekan)
+	if err != nil {
+		return WekanPlan{}, err
+	}
+	toCreate, toEnable, toDisable := fromConfig.ListWekanChanges(fromWekan)
+	plan.UsersToCreate = sortedWekanUsernames(toCreate)
+	plan.UsersToEnable = sortedWekanUsernames(selectSlice(toEnable, func(user libwekan.User) bool { return user.LoginDisabled }))
+	plan.UsersToDisable = sortedWekanUsernames(selectSlice(toDisable, func(user libwekan.User) bool { return !user.LoginDisabled }))
+
+	domainBoards, err := wekan.SelectDomainBoards(context.Background())
+	if err != nil {
+		return WekanPlan{}, err
+	}
+	boardsMembers := fromConfig.inferBoardsMember().addBoards(domainBoards)
+	for _, slug := range sortedKeys(boardsMembers) {
+		change, err := planBoardMembers(wekan, slug, boardsMembers[slug])
+		if err != nil {
+			return WekanPlan{}, err
+		}
+		if len(change.Add) > 0 || len(change.Remove) > 0 {
+			plan.BoardsMembers = append(plan.BoardsMembers, change)
+		}
+	}
+
+	var existingRules []TaskforceRule
+	for _, board := range domainBoards {
+		rules, err := wekan.SelectRulesFromBoardID(context.Background(), board.ID)
+		if err != nil {
+			return WekanPlan{}, err
+		}
+		existingRules = append(existingRules, taskforceRulesOf(board, rules)...)
+	}
+	boards := mapifySlice(domainBoards, func(board libwekan.Board) libwekan.BoardSlug { return board.Slug })
+	plan.RulesToAdd, plan.RulesToRemove = fromConfig.compareTaskforceRules(boards, existingRules)
+	return plan, nil
+}
+
+func planBoardMembers(wekan libwekan.Wekan, slug libwekan.BoardSlug, boardMembers Users) (BoardMembersChange, error) {
+	board, err := wekan.GetBoardFromSlug(context.Background(), slug)
+	if err != nil {
+		return BoardMembersChange{}, err
+	}
+	currentMembers, err := wekan.GetUsersFromIDs(context.Background(), mapSlice(board.Members, func(member libwekan.BoardMember) libwekan.UserID { return member.UserID }))
+	if err != nil {
+		return BoardMembersChange{}, err
+	}
+	activeMembers := selectSlice(currentMembers, func(user libwekan.User) bool {
+		return board.UserIsActiveMember(user) && selectGenuineUserFunc(wekan)(user)
+	})
+	wantedMembers := []libwekan.Username{wekan.AdminUsername()}
+	for username := range boardMembers {
+		wantedMembers = append(wantedMembers, libwekan.Username(username))
+	}
+	return compareBoardMembers(slug, mapSlice(activeMembers, libwekan.User.GetUsername), wantedMembers), nil
+}
+
+func compareBoardMembers(slug libwekan.BoardSlug, activeMembers []libwekan.Username, wantedMembers []libwekan.Username) BoardMembersChange {
+	_, remove, add := intersect(activeMembers, wantedMembers)
+	slices.Sort(add)
+	slices.Sort(remove)
+	return BoardMembersChange{Board: slug, Add: add, Remove: remove}
+}
+
+func taskforceRulesOf(board libwekan.Board, rules libwekan.Rules) []TaskforceRule {
+	var taskforceRules []TaskforceRule
+	for _, rule := range append(rules.SelectAddMemberToTaskforceRule(), rules.SelectRemoveMemberFromTaskforceRule()...) {
+		taskforceRules = append(taskforceRules, TaskforceRule{
+			Board:    board.Slug,
+			Label:    board.GetLabelByID(rule.Trigger.LabelID).Name,
+			Username: rule.Action.Username,
+			Action:   rule.Action.ActionType,
+		})
+	}
+	return taskforceRules
+}
+
+// compareTaskforceRules follows the rules of addMissingRulesAndCardMembership and removeExtraRulesAndCardsMembership
+func (users Users) compareTaskforceRules(boards map[libwekan.BoardSlug]libwekan.Board, existingRules []TaskforceRule) (toAdd []TaskforceRule, toRemove []TaskforceRule) {
+	var wantedRules []TaskforceRule
+	for _, user := range users {
+		for _, slug := range user.boards {
+			board, ok := boards[libwekan.BoardSlug(slug)]
+			if !ok {
+				continue
+			}
+			for _, label := range selectSlice(board.Labels, userHasTaskforceLabel(user)) {
+				for _, action := range []string{"addMember", "removeMember"} {
+					wantedRules = append(wantedRules, TaskforceRule{board.Slug, label.Name, libwekan.Username(user.email), action})
+				}
+			}
+		}
+	}
+	_, toRemove, toAdd = intersect(existingRules, wantedRules)
+	slices.SortFunc(toAdd, compareTaskforceRule)
+	slices.SortFunc(toRemove, compareTaskforceRule)
+	return toAdd, toRemove
+}
+
+// Changes counts the planned operations
+func (plan WekanPlan) Changes() int {
+	count := len(plan.UsersToCreate) + len(plan.UsersToEnable) + len(plan.UsersToDisable) +
+		len(plan.RulesToAdd) + len(plan.RulesToRemove)
+	for _, change := range plan.BoardsMembers {
+		count += len(change.Add) + len(change.Remove)
+	}
+	return count
+}
+
+// Print writes the plan in a readable format
+func (plan WekanPlan) Print(w io.Writer) {
+	fmt.Fprintf(w, "======= Wekan : %d modification(s)\n", plan.Changes())
+	printList(w, "utilisateurs à créer", plan.UsersToCreate)
+	printList(w, "utilisateurs à activer", plan.UsersToEnable)
+	printList(w, "utilisateurs à désactiver", plan.UsersToDisable)
+	if len(plan.BoardsMembers) > 0 {
+		fmt.Fprintf(w, "membres de tableaux à modifier (%d) :\n", len(plan.BoardsMembers))
+		for _, change := range plan.BoardsMembers {
+			fmt.Fprintf(w, "  %s%s\n", change.Board, formatAddRemove(
+				mapSlice(change.Add, libwekan.Username.String),
+				mapSlice(change.Remove, libwekan.Username.String),
+			))
+		}
+	}
+	printList(w, "règles de taskforce à créer", mapSlice(plan.RulesToAdd, TaskforceRule.String))
+	printList(w, "règles de taskforce à supprimer", mapSlice(plan.RulesToRemove, TaskforceRule.String))
+}
+
+func (rule TaskforceRule) String() string {
+	return fmt.Sprintf("%s/%s %s %s", rule.Board, rule.Label, rule.Action, rule.Username)
+}
+
+func compareTaskforceRule(a, b TaskforceRule) int {
+	return strings.Compare(a.String(), b.String())
+}
+
+func sortedWekanUsernames(users libwekan.Users) []libwekan.Username {
+	usernames := mapSlice(users, libwekan.User.GetUsername)
+	slices.Sort(usernames)
+	return usernames
+}
+
+func sortedKeys[Key ~string, Element any](m map[Key]Element) []Key {
+	ks := keys(m)
+	slices.Sort(ks)
+	return ks
+}
+
+// WekanPlanUpdate connects to Wekan and computes the changes WekanUpdate would apply
+func WekanPlanUpdate(url, database, admin string, users Users, slugDomainRegexp string) (WekanPlan, error) {
+	wekan, err := initWekan(url, database, admin, slugDomainRegexp)
+	if err != nil {
+		return WekanPlan{}, err
+	}
+	return PlanWekan(wekan, users.selectScopeWekan())
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/signaux-faibles/libwekan"
@@ -212,9 +213,10 @@ func (username Username) toWekanUsername() libwekan.Username {
 	return libwekan.Username(username)
 }
 
+// selectScopeWekan returns users of the wekan scope within their access period, the others are removed
 func (users Users) selectScopeWekan() Users {
 	hasScope := func(user User) bool { return contains(user.scope, "wekan") }
-	return selectMapByValue(users, hasScope)
+	return selectMapByValue(users.selectActive(time.Now()), hasScope)
 }
 
 // addAdmin modifie l'objet Users en place car c'est une map !